@@ -0,0 +1,481 @@
+// Command htpasswd manages htpasswd files like Apache's htpasswd, so that images do not need
+// apache2-utils. Besides Apache's flags it can list users with their hash scheme, bulk import
+// users from CSV, hash with argon2id and migrate users between htpasswd files and bbolt databases.
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/remoting/common/htpasswd"
+	"golang.org/x/term"
+)
+
+// exit codes of Apache's htpasswd
+const (
+	exitOK          = 0
+	exitFile        = 1
+	exitSyntax      = 2
+	exitMismatch    = 3
+	exitTooLong     = 5
+	exitIllegalName = 6
+)
+
+// limits and defaults of Apache's htpasswd
+const (
+	maxUsernameLength = 255
+	maxPasswordLength = 255
+	defaultBcryptCost = 5
+	minBcryptCost     = 4
+	maxBcryptCost     = 17
+)
+
+const usage = `Usage:
+	htpasswd [-cimB25AsDv] [-C cost] [-r rounds] passwordfile username
+	htpasswd -b[cmB25AsDv] [-C cost] [-r rounds] passwordfile username password
+
+	htpasswd -n[imB25As] [-C cost] [-r rounds] username
+	htpasswd -nb[mB25As] [-C cost] [-r rounds] username password
+
+	htpasswd --list passwordfile
+	htpasswd [-cmB25As] [-C cost] [-r rounds] --import=users.csv passwordfile
+
+	htpasswd migrate --from=[bolt:]store --to=[bolt:]store
+ -c  Create a new file.
+ -n  Don't update file; display results on stdout.
+ -b  Use the password from the command line rather than prompting for it.
+ -i  Read password from stdin without verification (for script usage).
+ -m  Force MD5 encryption of the password (default).
+ -2  Force SHA-256 crypt() hash of the password (very secure).
+ -5  Force SHA-512 crypt() hash of the password (very secure).
+ -B  Force bcrypt encryption of the password (very secure).
+ -A  Force argon2id hashing of the password (very secure).
+ -C  Set the computing time used for the bcrypt algorithm
+     (higher is more secure but slower, default: 5, valid: 4 to 17).
+ -r  Set the number of rounds used for the SHA-256, SHA-512 algorithms
+     (higher is more secure but slower, default: 5000).
+ -s  Force SHA-1 encryption of the password (insecure).
+ -D  Delete the specified user.
+ -v  Verify password for the specified user.
+ --list          List the users of passwordfile with their hash scheme.
+ --import=FILE   Add or update the users of a CSV file with lines "username,password".
+ migrate         Copy all users with their hashes from one store to another, stores are
+                 htpasswd files or bbolt databases with the bolt: prefix.
+`
+
+// boltPrefix marks a bbolt database in the store arguments of migrate
+const boltPrefix = "bolt:"
+
+// options parsed command line
+type options struct {
+	create, display, batch, stdin, delete, verify, list bool
+	importFile                                          string
+	migrateFrom, migrateTo                              string
+	algorithm                                           htpasswd.HashAlgorithm
+	hashOptions                                         htpasswd.HashOptions
+	args                                                []string
+}
+
+// exitError an error with the exit code of the process
+type exitError struct {
+	code int
+	msg  string
+}
+
+func (e *exitError) Error() string { return e.msg }
+
+func fail(code int, format string, v ...interface{}) error {
+	return &exitError{code: code, msg: fmt.Sprintf(format, v...)}
+}
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+func run(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	opts, err := parseArgs(args)
+	if err == nil {
+		err = execute(opts, stdin, stdout, stderr)
+	}
+	if err == nil {
+		return exitOK
+	}
+	code := exitFile
+	var e *exitError
+	if errors.As(err, &e) {
+		code = e.code
+	}
+	fmt.Fprintf(stderr, "htpasswd: %s\n", err)
+	if code == exitSyntax {
+		fmt.Fprint(stderr, usage)
+	}
+	return code
+}
+
+func parseArgs(args []string) (opts *options, err error) {
+	opts = &options{algorithm: htpasswd.HashMD5, hashOptions: htpasswd.DefaultHashOptions}
+	opts.hashOptions.BcryptCost = defaultBcryptCost
+	if len(args) > 0 && args[0] == "migrate" {
+		return parseMigrateArgs(opts, args[1:])
+	}
+	for len(args) > 0 && strings.HasPrefix(args[0], "-") && args[0] != "-" {
+		arg := args[0]
+		args = args[1:]
+		if arg == "--" {
+			break
+		}
+		if strings.HasPrefix(arg, "--") {
+			switch {
+			case arg == "--list":
+				opts.list = true
+			case strings.HasPrefix(arg, "--import="):
+				opts.importFile = strings.TrimPrefix(arg, "--import=")
+			default:
+				return nil, fail(exitSyntax, "unknown option %s", arg)
+			}
+			continue
+		}
+		for _, flag := range arg[1:] {
+			switch flag {
+			case 'c':
+				opts.create = true
+			case 'n':
+				opts.display = true
+			case 'b':
+				opts.batch = true
+			case 'i':
+				opts.stdin = true
+			case 'm':
+				opts.algorithm = htpasswd.HashMD5
+			case '2':
+				opts.algorithm = htpasswd.HashSHA256
+			case '5':
+				opts.algorithm = htpasswd.HashSHA512
+			case 'B':
+				opts.algorithm = htpasswd.HashBCrypt
+			case 'A':
+				opts.algorithm = htpasswd.HashArgon2
+			case 's':
+				opts.algorithm = htpasswd.HashSHA
+			case 'D':
+				opts.delete = true
+			case 'v':
+				opts.verify = true
+			case 'C', 'r':
+				if len(args) == 0 {
+					return nil, fail(exitSyntax, "option -%c requires a value", flag)
+				}
+				value, err := strconv.Atoi(args[0])
+				args = args[1:]
+				if err != nil {
+					return nil, fail(exitSyntax, "option -%c requires a number", flag)
+				}
+				if flag == 'C' {
+					if value < minBcryptCost || value > maxBcryptCost {
+						return nil, fail(exitSyntax, "bcrypt cost must be between %d and %d", minBcryptCost, maxBcryptCost)
+					}
+					opts.hashOptions.BcryptCost = value
+				} else {
+					opts.hashOptions.ShaCryptRounds = value
+				}
+			case 'd', 'p':
+				return nil, fail(exitSyntax, "option -%c is not supported, its hashes are insecure", flag)
+			default:
+				return nil, fail(exitSyntax, "unknown option -%c", flag)
+			}
+		}
+	}
+	opts.args = args
+
+	expected := 2
+	switch {
+	case opts.list || opts.importFile != "":
+		expected = 1
+		if opts.display && opts.importFile != "" {
+			expected = 0
+		}
+	case opts.display:
+		expected = 1
+	}
+	if opts.batch && !opts.list && opts.importFile == "" && !opts.delete {
+		expected++
+	}
+	if len(args) != expected {
+		return nil, fail(exitSyntax, "expected %d arguments but got %d", expected, len(args))
+	}
+	if opts.display && (opts.create || opts.delete || opts.verify || opts.list) {
+		return nil, fail(exitSyntax, "-n cannot be combined with -c, -D, -v or --list")
+	}
+	if opts.delete && opts.verify {
+		return nil, fail(exitSyntax, "-D and -v are mutually exclusive")
+	}
+	if opts.stdin && opts.batch {
+		return nil, fail(exitSyntax, "-i and -b are mutually exclusive")
+	}
+	return opts, nil
+}
+
+func parseMigrateArgs(opts *options, args []string) (*options, error) {
+	for _, arg := range args {
+		switch {
+		case strings.HasPrefix(arg, "--from="):
+			opts.migrateFrom = strings.TrimPrefix(arg, "--from=")
+		case strings.HasPrefix(arg, "--to="):
+			opts.migrateTo = strings.TrimPrefix(arg, "--to=")
+		default:
+			return nil, fail(exitSyntax, "unknown migrate argument %s", arg)
+		}
+	}
+	if opts.migrateFrom == "" || opts.migrateTo == "" {
+		return nil, fail(exitSyntax, "migrate requires --from and --to")
+	}
+	return opts, nil
+}
+
+func execute(opts *options, stdin io.Reader, stdout, stderr io.Writer) error {
+	if opts.migrateFrom != "" {
+		return migrate(opts.migrateFrom, opts.migrateTo, stderr)
+	}
+	if opts.list {
+		return list(opts.args[0], stdout)
+	}
+	if opts.importFile != "" {
+		return importCSV(opts, stdout, stderr)
+	}
+	file, user := "", opts.args[0]
+	if !opts.display {
+		file, user = opts.args[0], opts.args[1]
+	}
+	if err := checkUsername(user); err != nil {
+		return err
+	}
+	store := htpasswd.NewStore(file)
+	if opts.delete {
+		err := store.RemoveUser(user)
+		if err == htpasswd.ErrUserNotFound {
+			return fail(exitFile, "user %s not found", user)
+		}
+		if err == nil {
+			fmt.Fprintf(stderr, "Deleting password for user %s\n", user)
+		}
+		return err
+	}
+
+	password, err := readPassword(opts, stdin, stderr)
+	if err != nil {
+		return err
+	}
+	if opts.verify {
+		ok, err := store.Verify(user, password)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return fail(exitMismatch, "password verification failed")
+		}
+		fmt.Fprintf(stderr, "Password for user %s correct.\n", user)
+		return nil
+	}
+
+	hash, err := htpasswd.HashPassword(password, opts.algorithm, opts.hashOptions)
+	if err != nil {
+		return err
+	}
+	if opts.display {
+		fmt.Fprintln(stdout, user+htpasswd.PasswordSeparator+hash)
+		return nil
+	}
+	return update(opts, store, func(passwords htpasswd.HashedPasswords) {
+		action := "Adding"
+		if _, ok := passwords[user]; ok {
+			action = "Updating"
+		}
+		passwords[user] = hash
+		fmt.Fprintf(stderr, "%s password for user %s\n", action, user)
+	})
+}
+
+// update change the users of the password file, -c starts with an empty file
+func update(opts *options, store *htpasswd.Store, fn func(passwords htpasswd.HashedPasswords)) error {
+	if !opts.create {
+		if _, err := os.Stat(store.File()); err != nil {
+			return fail(exitFile, "cannot modify file %s; use '-c' to create it", store.File())
+		}
+	}
+	return store.UpdateDocument(func(doc *htpasswd.Document) error {
+		if opts.create {
+			*doc = *htpasswd.NewDocument()
+		}
+		passwords := doc.Passwords()
+		fn(passwords)
+		doc.Apply(passwords)
+		return nil
+	})
+}
+
+func checkUsername(user string) error {
+	if len(user) > maxUsernameLength {
+		return fail(exitTooLong, "username must not be longer than %d characters", maxUsernameLength)
+	}
+	if len(user) == 0 || strings.Contains(user, htpasswd.PasswordSeparator) {
+		return fail(exitIllegalName, "username contains illegal character '%s'", htpasswd.PasswordSeparator)
+	}
+	return nil
+}
+
+func readPassword(opts *options, stdin io.Reader, stderr io.Writer) (password string, err error) {
+	lines := bufio.NewReader(stdin)
+	switch {
+	case opts.batch:
+		password = opts.args[len(opts.args)-1]
+	case opts.stdin:
+		password, err = readLine(lines)
+	default:
+		password, err = prompt(stdin, lines, stderr, "New password: ")
+		if err == nil && !opts.verify {
+			var again string
+			again, err = prompt(stdin, lines, stderr, "Re-type new password: ")
+			if err == nil && again != password {
+				err = fail(exitMismatch, "password verification error")
+			}
+		}
+	}
+	if err == nil && len(password) > maxPasswordLength {
+		err = fail(exitTooLong, "password must not be longer than %d characters", maxPasswordLength)
+	}
+	return
+}
+
+// prompt read a password without echo when stdin is a terminal, otherwise read a line
+func prompt(stdin io.Reader, lines *bufio.Reader, stderr io.Writer, text string) (string, error) {
+	fmt.Fprint(stderr, text)
+	if f, ok := stdin.(*os.File); ok && term.IsTerminal(int(f.Fd())) {
+		password, err := term.ReadPassword(int(f.Fd()))
+		fmt.Fprintln(stderr)
+		return string(password), err
+	}
+	return readLine(lines)
+}
+
+func readLine(lines *bufio.Reader) (string, error) {
+	line, err := lines.ReadString('\n')
+	if err != nil && (err != io.EOF || len(line) == 0) {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func list(file string, stdout io.Writer) error {
+	doc, err := htpasswd.ParseDocumentFile(file)
+	if err != nil {
+		return err
+	}
+	for _, user := range doc.Users() {
+		hash, _ := doc.Get(user)
+		scheme := string(htpasswd.IdentifyHash(hash))
+		if scheme == "" {
+			scheme = "unknown"
+		}
+		fmt.Fprintln(stdout, user+"\t"+scheme)
+	}
+	return nil
+}
+
+// importCSV hash the passwords of a "username,password" CSV file, with -n the users are printed
+// instead of written to the password file
+func importCSV(opts *options, stdout, stderr io.Writer) error {
+	f, err := os.Open(opts.importFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	reader := csv.NewReader(f)
+	reader.FieldsPerRecord = 2
+	reader.Comment = '#'
+	records, err := reader.ReadAll()
+	if err != nil {
+		return err
+	}
+	hashes := htpasswd.HashedPasswords{}
+	names := []string{}
+	for _, record := range records {
+		user, password := strings.TrimSpace(record[0]), record[1]
+		if err = checkUsername(user); err != nil {
+			return err
+		}
+		if len(password) == 0 {
+			return fail(exitSyntax, "empty password for user %s", user)
+		}
+		hashes[user], err = htpasswd.HashPassword(password, opts.algorithm, opts.hashOptions)
+		if err != nil {
+			return err
+		}
+		names = append(names, user)
+	}
+	if opts.display {
+		for _, user := range names {
+			fmt.Fprintln(stdout, user+htpasswd.PasswordSeparator+hashes[user])
+		}
+		return nil
+	}
+	err = update(opts, htpasswd.NewStore(opts.args[0]), func(passwords htpasswd.HashedPasswords) {
+		for _, user := range names {
+			passwords[user] = hashes[user]
+		}
+	})
+	if err == nil {
+		fmt.Fprintf(stderr, "Imported %d users\n", len(names))
+	}
+	return err
+}
+
+// migrate copy all users of the store from to the store to
+func migrate(from, to string, stderr io.Writer) error {
+	// opening a missing bolt database would create it empty, so bolt sources are checked too
+	if _, err := os.Stat(strings.TrimPrefix(from, boltPrefix)); err != nil {
+		return fail(exitFile, "cannot read file %s", strings.TrimPrefix(from, boltPrefix))
+	}
+	source, err := openStore(from)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+	target, err := openStore(to)
+	if err != nil {
+		return err
+	}
+	defer target.Close()
+	n, err := htpasswd.Migrate(source, target)
+	if err == nil {
+		fmt.Fprintf(stderr, "Migrated %d users\n", n)
+	}
+	return err
+}
+
+// closableStore a credential store that may hold an open database
+type closableStore interface {
+	htpasswd.CredentialStore
+	Close() error
+}
+
+// fileStore a htpasswd file store, there is nothing to close
+type fileStore struct {
+	*htpasswd.Store
+}
+
+func (fileStore) Close() error { return nil }
+
+// openStore open a bbolt database for bolt:file and a htpasswd file otherwise
+func openStore(spec string) (closableStore, error) {
+	if strings.HasPrefix(spec, boltPrefix) {
+		return htpasswd.OpenBoltStore(strings.TrimPrefix(spec, boltPrefix), time.Second)
+	}
+	return fileStore{htpasswd.NewStore(spec)}, nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func htpasswdRun(stdin string, args ...string) (code int, stdout, stderr string) {
+	var out, errOut bytes.Buffer
+	code = run(args, strings.NewReader(stdin), &out, &errOut)
+	return code, out.String(), errOut.String()
+}
+
+func TestHtpasswdCommand(t *testing.T) {
+	dir, err := ioutil.TempDir("", "htpasswd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	f := filepath.Join(dir, "passwords")
+
+	if code, _, _ := htpasswdRun("", "-b", f, "a", "a"); code != exitFile {
+		t.Fatal("a missing file requires -c, got", code)
+	}
+	if code, _, stderr := htpasswdRun("", "-cbB", "-C", "4", f, "a", "a"); code != exitOK {
+		t.Fatal("failed to create file", stderr)
+	}
+	if code, _, stderr := htpasswdRun("b\nb\n", "-5", f, "b"); code != exitOK || !strings.Contains(stderr, "Adding password for user b") {
+		t.Fatal("failed to add b", stderr)
+	}
+	if code, _, _ := htpasswdRun("b\n", "-v", f, "b"); code != exitOK {
+		t.Fatal("failed to verify b")
+	}
+	if code, _, _ := htpasswdRun("", "-vb", f, "a", "wrong"); code != exitMismatch {
+		t.Fatal("wrong password verified")
+	}
+	if code, stdout, _ := htpasswdRun("", "--list", f); code != exitOK || stdout != "a\tbcrypt\nb\tsha512\n" {
+		t.Fatal("unexpected list", stdout)
+	}
+	if code, _, _ := htpasswdRun("", "-D", f, "a"); code != exitOK {
+		t.Fatal("failed to delete a")
+	}
+	if code, stdout, _ := htpasswdRun("", "-nbs", "c", "c"); code != exitOK || stdout != "c:{SHA}hKUWhBuneltGSN4s0N/LMOpG27Q=\n" {
+		t.Fatal("unexpected output", stdout)
+	}
+	if code, _, _ := htpasswdRun("", "-b", f, "x:y", "x"); code != exitIllegalName {
+		t.Fatal("usernames with a colon must be rejected")
+	}
+	if code, _, _ := htpasswdRun("", "-nbd", "c", "c"); code != exitSyntax {
+		t.Fatal("crypt must be rejected")
+	}
+
+	csvFile := filepath.Join(dir, "users.csv")
+	if err = ioutil.WriteFile(csvFile, []byte("# users\nd,d\ne,e\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if code, _, stderr := htpasswdRun("", "-2", "--import="+csvFile, f); code != exitOK {
+		t.Fatal("failed to import", stderr)
+	}
+	if code, stdout, _ := htpasswdRun("", "--list", f); code != exitOK || stdout != "b\tsha512\nd\tsha256\ne\tsha256\n" {
+		t.Fatal("unexpected list after import", stdout)
+	}
+}
+
+func TestHtpasswdMigrate(t *testing.T) {
+	dir := t.TempDir()
+	f := filepath.Join(dir, "passwords")
+	db := filepath.Join(dir, "passwords.db")
+	back := filepath.Join(dir, "back")
+	if code, _, stderr := htpasswdRun("", "-cbB", "-C", "4", f, "a", "a"); code != exitOK {
+		t.Fatal("failed to create file", stderr)
+	}
+	if code, _, stderr := htpasswdRun("", "-b5", f, "b", "b"); code != exitOK {
+		t.Fatal("failed to add b", stderr)
+	}
+	if code, _, stderr := htpasswdRun("", "migrate", "--from="+f, "--to=bolt:"+db); code != exitOK || !strings.Contains(stderr, "Migrated 2 users") {
+		t.Fatal("failed to migrate to bolt", stderr)
+	}
+	if code, _, stderr := htpasswdRun("", "migrate", "--from=bolt:"+db, "--to="+back); code != exitOK {
+		t.Fatal("failed to migrate from bolt", stderr)
+	}
+	if code, stdout, _ := htpasswdRun("", "--list", back); code != exitOK || stdout != "a\tbcrypt\nb\tsha512\n" {
+		t.Fatal("unexpected list after migration", stdout)
+	}
+	if code, _, _ := htpasswdRun("", "-vb", back, "b", "b"); code != exitOK {
+		t.Fatal("migrated password does not verify")
+	}
+	if code, _, _ := htpasswdRun("", "migrate", "--from="+f); code != exitSyntax {
+		t.Fatal("migrate without --to must be rejected")
+	}
+	if code, _, _ := htpasswdRun("", "migrate", "--from="+filepath.Join(dir, "missing"), "--to="+back); code != exitFile {
+		t.Fatal("a missing source must be rejected")
+	}
+	if code, _, _ := htpasswdRun("", "migrate", "--from=bolt:"+filepath.Join(dir, "missing.db"), "--to="+back); code != exitFile {
+		t.Fatal("a missing bolt source must be rejected")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "missing.db")); !os.IsNotExist(err) {
+		t.Fatal("a missing bolt source was created")
+	}
+}
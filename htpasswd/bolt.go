@@ -0,0 +1,152 @@
+package htpasswd
+
+import (
+	"errors"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// boltBucket holds name => hash
+var boltBucket = []byte("htpasswd")
+
+// BoltStore a CredentialStore in a single file bbolt database, for user counts that outgrow
+// htpasswd files
+type BoltStore struct {
+	db *bolt.DB
+}
+
+// OpenBoltStore open or create a database file, other processes opening the same file block
+// for at most timeout
+func OpenBoltStore(file string, timeout time.Duration) (*BoltStore, error) {
+	db, err := bolt.Open(file, 0600, &bolt.Options{Timeout: timeout})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &BoltStore{db: db}, nil
+}
+
+// Close the database
+func (s *BoltStore) Close() error {
+	return s.db.Close()
+}
+
+// Read all users
+func (s *BoltStore) Read() (passwords HashedPasswords, err error) {
+	passwords = HashedPasswords{}
+	err = s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBucket).ForEach(func(name, hash []byte) error {
+			passwords[string(name)] = string(hash)
+			return nil
+		})
+	})
+	return
+}
+
+// SetPassword set a password for a user with a hashing algo, the current hash is read and
+// replaced in one transaction
+func (s *BoltStore) SetPassword(name, password string, hashAlgorithm HashAlgorithm) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltBucket)
+		passwords := HashedPasswords{}
+		// the current hash is needed by the password policy
+		if hash := bucket.Get([]byte(name)); hash != nil {
+			passwords[name] = string(hash)
+		}
+		if err := passwords.SetPassword(name, password, hashAlgorithm); err != nil {
+			return err
+		}
+		return bucket.Put([]byte(name), []byte(passwords[name]))
+	})
+}
+
+// SetPasswordHash directly set a hash for a user
+func (s *BoltStore) SetPasswordHash(name, hash string) error {
+	if len(hash) == 0 {
+		return errors.New("you might want to rethink your hashing algorithm, it left you with an empty hash")
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBucket).Put([]byte(name), []byte(hash))
+	})
+}
+
+// RemoveUser remove an existing user, returns ErrUserNotFound if the user does not exist
+func (s *BoltStore) RemoveUser(name string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltBucket)
+		if bucket.Get([]byte(name)) == nil {
+			return ErrUserNotFound
+		}
+		return bucket.Delete([]byte(name))
+	})
+}
+
+// Update run fn on all users and store the result in one transaction if fn did not return an error
+func (s *BoltStore) Update(fn func(passwords HashedPasswords) error) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltBucket)
+		passwords := HashedPasswords{}
+		err := bucket.ForEach(func(name, hash []byte) error {
+			passwords[string(name)] = string(hash)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		err = fn(passwords)
+		if err != nil {
+			return err
+		}
+		// delete removed users and write everything else
+		var removed [][]byte
+		err = bucket.ForEach(func(name, _ []byte) error {
+			if _, ok := passwords[string(name)]; !ok {
+				removed = append(removed, append([]byte{}, name...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, name := range removed {
+			if err = bucket.Delete(name); err != nil {
+				return err
+			}
+		}
+		for name, hash := range passwords {
+			if err = bucket.Put([]byte(name), []byte(hash)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Verify check the password of a user
+func (s *BoltStore) Verify(name, password string) (ok bool, err error) {
+	var hash string
+	err = s.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(boltBucket).Get([]byte(name))
+		if v != nil {
+			ok = true
+			hash = string(v)
+		}
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+	if !ok {
+		verifyUnknownUser(password)
+		return false, nil
+	}
+	return CheckPassword(password, hash), nil
+}
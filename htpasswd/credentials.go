@@ -0,0 +1,125 @@
+package htpasswd
+
+import (
+	"errors"
+	"sync"
+)
+
+// CredentialStore a backend holding users and their password hashes. Store keeps them in a
+// htpasswd file, BoltStore in a single file key value database and MemoryStore in memory.
+type CredentialStore interface {
+	Verifier
+	// Read all users
+	Read() (HashedPasswords, error)
+	// SetPassword set a password for a user with a hashing algo
+	SetPassword(name, password string, hashAlgorithm HashAlgorithm) error
+	// SetPasswordHash directly set a hash for a user
+	SetPasswordHash(name, hash string) error
+	// RemoveUser remove an existing user, returns an error if the user does not exist
+	RemoveUser(name string) error
+	// Update run fn on all users and store the result if fn did not return an error
+	Update(fn func(passwords HashedPasswords) error) error
+}
+
+var (
+	_ CredentialStore = &Store{}
+	_ CredentialStore = &MemoryStore{}
+	_ CredentialStore = &BoltStore{}
+)
+
+// ErrUserNotFound is returned when removing an unknown user
+var ErrUserNotFound = errors.New("user did not exist in file")
+
+// MemoryStore a CredentialStore that only lives in memory, mostly useful for tests
+type MemoryStore struct {
+	mu        sync.RWMutex
+	passwords HashedPasswords
+}
+
+// NewMemoryStore create a store with a copy of passwords, passwords may be nil
+func NewMemoryStore(passwords HashedPasswords) *MemoryStore {
+	s := &MemoryStore{passwords: HashedPasswords{}}
+	for name, hash := range passwords {
+		s.passwords[name] = hash
+	}
+	return s
+}
+
+// Read a copy of all users
+func (s *MemoryStore) Read() (HashedPasswords, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return NewMemoryStore(s.passwords).passwords, nil
+}
+
+// SetPassword set a password for a user with a hashing algo
+func (s *MemoryStore) SetPassword(name, password string, hashAlgorithm HashAlgorithm) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.passwords.SetPassword(name, password, hashAlgorithm)
+}
+
+// SetPasswordHash directly set a hash for a user
+func (s *MemoryStore) SetPasswordHash(name, hash string) error {
+	if len(hash) == 0 {
+		return errors.New("you might want to rethink your hashing algorithm, it left you with an empty hash")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.passwords[name] = hash
+	return nil
+}
+
+// RemoveUser remove an existing user, returns ErrUserNotFound if the user does not exist
+func (s *MemoryStore) RemoveUser(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.passwords[name]; !ok {
+		return ErrUserNotFound
+	}
+	delete(s.passwords, name)
+	return nil
+}
+
+// Update run fn on a copy of all users and keep the result if fn did not return an error
+func (s *MemoryStore) Update(fn func(passwords HashedPasswords) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	passwords := NewMemoryStore(s.passwords).passwords
+	err := fn(passwords)
+	if err != nil {
+		return err
+	}
+	s.passwords = passwords
+	return nil
+}
+
+// Verify check the password of a user
+func (s *MemoryStore) Verify(name, password string) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if _, ok := s.passwords[name]; !ok {
+		verifyUnknownUser(password)
+		return false, nil
+	}
+	return s.passwords.Verify(name, password), nil
+}
+
+// Migrate copy all users with their hashes from one store to another in a single update, users
+// that already exist in to are overwritten. Returns the number of copied users.
+func Migrate(from, to CredentialStore) (n int, err error) {
+	passwords, err := from.Read()
+	if err != nil {
+		return 0, err
+	}
+	err = to.Update(func(existing HashedPasswords) error {
+		for name, hash := range passwords {
+			existing[name] = hash
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(passwords), nil
+}
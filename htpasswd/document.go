@@ -0,0 +1,207 @@
+package htpasswd
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// CommentPrefix starts a comment line
+const CommentPrefix = "#"
+
+// LineKind kind of a line in a htpasswd Document
+type LineKind int
+
+const (
+	// LineUser a name:hash record
+	LineUser LineKind = iota
+	// LineComment a line starting with #
+	LineComment
+	// LineBlank an empty or whitespace only line
+	LineBlank
+	// LineUnknown anything else without a colon, kept as it is
+	LineUnknown
+)
+
+// Line one line of a htpasswd Document, Raw is written back unchanged unless the user was edited
+type Line struct {
+	Kind LineKind
+	Raw  string
+	Name string
+	Hash string
+}
+
+// Document a htpasswd file that keeps the order of its users, comments, blank lines and lines
+// it does not understand, so that edits produce minimal diffs
+type Document struct {
+	lines []*Line
+	users map[string]*Line
+}
+
+// NewDocument an empty document
+func NewDocument() *Document {
+	return &Document{users: map[string]*Line{}}
+}
+
+// ParseDocumentFile load a htpasswd file as a document
+func ParseDocumentFile(file string) (doc *Document, err error) {
+	htpasswdBytes, err := ioutil.ReadFile(file)
+	if err != nil {
+		return
+	}
+	if len(htpasswdBytes) > MaxHtpasswdFilesize {
+		err = errors.New("this file is too large, use a database instead")
+		return
+	}
+	return ParseDocument(htpasswdBytes)
+}
+
+// ParseDocument parse htpasswd bytes into a document, users must not be defined twice and lines
+// with a colon must be name:hash records
+func ParseDocument(htpasswdBytes []byte) (doc *Document, err error) {
+	doc = NewDocument()
+	content := string(htpasswdBytes)
+	if len(content) == 0 {
+		return
+	}
+	content = strings.TrimSuffix(content, LineSeparator)
+	for lineNumber, raw := range strings.Split(content, LineSeparator) {
+		line := parseLine(raw)
+		if line.Kind == LineUnknown && strings.Contains(raw, PasswordSeparator) {
+			// a user line that does not parse cannot be matched by name, an edit of that user
+			// would add a second line for it
+			return nil, fmt.Errorf("invalid htpasswords file - malformed user on line %d", lineNumber+1)
+		}
+		if line.Kind == LineUser {
+			if _, alreadyExists := doc.users[line.Name]; alreadyExists {
+				return nil, errors.New("invalid htpasswords file - user " + line.Name + " was already defined")
+			}
+			doc.users[line.Name] = line
+		}
+		doc.lines = append(doc.lines, line)
+	}
+	return
+}
+
+func parseLine(raw string) *Line {
+	line := &Line{Raw: raw}
+	trimmed := strings.Trim(strings.TrimSuffix(raw, "\r"), " \t")
+	switch {
+	case len(trimmed) == 0:
+		line.Kind = LineBlank
+	case strings.HasPrefix(trimmed, CommentPrefix):
+		line.Kind = LineComment
+	default:
+		parts := strings.Split(trimmed, PasswordSeparator)
+		if len(parts) != 2 || len(strings.Trim(parts[0], " ")) == 0 {
+			line.Kind = LineUnknown
+			return line
+		}
+		line.Kind = LineUser
+		line.Name = strings.Trim(parts[0], " ")
+		line.Hash = strings.Trim(parts[1], " ")
+	}
+	return line
+}
+
+// Lines all lines in file order
+func (d *Document) Lines() []Line {
+	lines := make([]Line, len(d.lines))
+	for i, line := range d.lines {
+		lines[i] = *line
+	}
+	return lines
+}
+
+// Get the hash of a user
+func (d *Document) Get(name string) (hash string, ok bool) {
+	line, ok := d.users[name]
+	if !ok {
+		return "", false
+	}
+	return line.Hash, true
+}
+
+// Set the hash of a user, existing users keep their position, new users are appended
+func (d *Document) Set(name, hash string) {
+	line, ok := d.users[name]
+	if !ok {
+		line = &Line{Kind: LineUser, Name: name}
+		d.users[name] = line
+		d.lines = append(d.lines, line)
+	}
+	if line.Hash == hash && line.Raw != "" {
+		return
+	}
+	line.Hash = hash
+	line.Raw = name + PasswordSeparator + hash
+}
+
+// Remove a user, returns false if the user did not exist
+func (d *Document) Remove(name string) bool {
+	line, ok := d.users[name]
+	if !ok {
+		return false
+	}
+	delete(d.users, name)
+	for i, l := range d.lines {
+		if l == line {
+			d.lines = append(d.lines[:i], d.lines[i+1:]...)
+			break
+		}
+	}
+	return true
+}
+
+// AddComment append a comment line, the CommentPrefix is added
+func (d *Document) AddComment(comment string) {
+	d.lines = append(d.lines, &Line{Kind: LineComment, Raw: CommentPrefix + " " + comment})
+}
+
+// Users names in file order
+func (d *Document) Users() []string {
+	names := make([]string, 0, len(d.users))
+	for _, line := range d.lines {
+		if line.Kind == LineUser {
+			names = append(names, line.Name)
+		}
+	}
+	return names
+}
+
+// Passwords a map copy of the users
+func (d *Document) Passwords() HashedPasswords {
+	passwords := make(HashedPasswords, len(d.users))
+	for name, line := range d.users {
+		passwords[name] = line.Hash
+	}
+	return passwords
+}
+
+// Apply make the document match passwords: changed hashes are updated in place, missing users
+// are removed and new users are appended in alphabetical order
+func (d *Document) Apply(passwords HashedPasswords) {
+	for _, name := range d.Users() {
+		if _, ok := passwords[name]; !ok {
+			d.Remove(name)
+		}
+	}
+	for _, name := range passwords.Names() {
+		d.Set(name, passwords[name])
+	}
+}
+
+// Bytes bytes representation
+func (d *Document) Bytes() []byte {
+	passwordBytes := []byte{}
+	for _, line := range d.lines {
+		passwordBytes = append(passwordBytes, []byte(line.Raw+LineSeparator)...)
+	}
+	return passwordBytes
+}
+
+// WriteToFile put the document to a file, the file is replaced atomically and keeps its mode
+func (d *Document) WriteToFile(file string) error {
+	return writeFileAtomic(file, d.Bytes(), 0644)
+}
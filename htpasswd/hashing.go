@@ -1,230 +1,168 @@
 package htpasswd
 
 import (
-	"bytes"
-	"crypto/md5"
 	"crypto/rand"
 	"crypto/sha1"
+	"crypto/subtle"
 	"encoding/base64"
-	"hash"
+	"errors"
+	"fmt"
 	"io"
-	"log"
+	"strings"
 
+	"golang.org/x/crypto/argon2"
 	"golang.org/x/crypto/bcrypt"
 )
 
-func hashMd5(password string) string {
-	salt := generateSalt()
-	m := FromSalt(salt)
-	m.Write([]byte(password))
-	p := m.Sum(nil)
-	return "$apr1$" + string(salt) + "$" + string(p)
+func hashSha(password string) string {
+	s := sha1.New()
+	s.Write([]byte(password))
+	passwordSum := []byte(s.Sum(nil))
+	return base64.StdEncoding.EncodeToString(passwordSum)
 }
 
-// The size of an MD% APR Salt
-const PW_SALT_BYTES = 8
-
-// The size of an MD5 APR1 checksum in bytes.
-const Size = 22
-
-type md5Apr struct {
-	salt []byte
-	pass []byte
+func hashBcrypt(password string, cost int) (hash string, err error) {
+	passwordBytes, err := bcrypt.GenerateFromPassword([]byte(password), cost)
+	if err != nil {
+		return
+	}
+	return string(passwordBytes), nil
 }
 
-var _ hash.Hash = &md5Apr{}
-
-// New returns a new md5Apr1 hash computing the MD5Apr1 checksum based on a randomly generated salt
-func New() hash.Hash {
-	return newMd5Apr1([]byte{})
+// Argon2Params cost parameters of an argon2id hash
+type Argon2Params struct {
+	// Time number of passes over the memory
+	Time uint32
+	// Memory in KiB
+	Memory uint32
+	// Threads degree of parallelism
+	Threads uint8
+	// SaltLength in bytes
+	SaltLength uint32
+	// KeyLength length of the derived key in bytes
+	KeyLength uint32
 }
 
-// FromSalt returns a new md5Apr1 hash computing the MD5Apr1 checksum based on a fixed salt value
-// Take care to pass a randomly generated salt if using this
-func FromSalt(salt []byte) hash.Hash {
-	return newMd5Apr1(salt)
+// DefaultArgon2Params parameters recommended by golang.org/x/crypto/argon2
+var DefaultArgon2Params = Argon2Params{
+	Time:       1,
+	Memory:     64 * 1024,
+	Threads:    4,
+	SaltLength: 16,
+	KeyLength:  32,
 }
 
-func newMd5Apr1(salt []byte) hash.Hash {
-
-	var bs []byte
-
-	if len(salt) == 0 {
-		bs = generateSalt()
-	} else {
-		n := len(salt)
-		if len(salt) > 8 {
-			n = 8
-		}
-
-		bs = salt[:n]
+// withDefaults params with the zero fields taken from DefaultArgon2Params
+func (params Argon2Params) withDefaults() Argon2Params {
+	if params.Time == 0 {
+		params.Time = DefaultArgon2Params.Time
 	}
-
-	return &md5Apr{
-		salt: bs,
+	if params.Memory == 0 {
+		params.Memory = DefaultArgon2Params.Memory
 	}
-
+	if params.Threads == 0 {
+		params.Threads = DefaultArgon2Params.Threads
+	}
+	if params.SaltLength == 0 {
+		params.SaltLength = DefaultArgon2Params.SaltLength
+	}
+	if params.KeyLength == 0 {
+		params.KeyLength = DefaultArgon2Params.KeyLength
+	}
+	return params
 }
 
-func generateSalt() []byte {
-	bs := make([]byte, PW_SALT_BYTES)
-	_, err := io.ReadFull(rand.Reader, bs)
-	if err != nil {
-		log.Fatal(err)
+func hashArgon2(password string, params Argon2Params) (string, error) {
+	params = params.withDefaults()
+	if params.Memory < 8*uint32(params.Threads) {
+		return "", errors.New("argon2 memory must be at least 8 KiB per thread")
 	}
-
-	dst := make([]byte, base64.StdEncoding.EncodedLen(len(bs)))
-	base64.RawStdEncoding.Encode(dst, bs)
-	n := len(dst)
-	if n > 8 {
-		n = 8
+	salt := make([]byte, params.SaltLength)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return "", err
 	}
-	return dst[:n]
+	key := argon2.IDKey([]byte(password), salt, params.Time, params.Memory, params.Threads, params.KeyLength)
+	return encodeArgon2(params, salt, key), nil
 }
 
-func (m *md5Apr) checksum() []byte {
-
-	bin := make([]byte, len(m.pass))
-	text := make([]byte, len(m.pass))
-
-	copy(bin, m.pass)
-	copy(text, m.pass)
-
-	bin = append(bin, m.salt...)
-	bin = append(bin, m.pass...)
-
-	// start with a hash of password and salt
-	initBin := md5.Sum(bin)
-
-	text = append(text, "$apr1$"...)
-	text = append(text, m.salt...)
-	// begin an initial string with hash and salt
-	initText := bytes.NewBuffer(text)
+// encodeArgon2 format an argon2id hash in the PHC string format
+func encodeArgon2(params Argon2Params, salt, key []byte) string {
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, params.Memory, params.Time, params.Threads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	)
+}
 
-	// add crap to the string willy-nilly
-	for i := len(m.pass); i > 0; i -= 16 {
-		lim := i
-		if lim > 16 {
-			lim = 16
-		}
-		initText.Write(initBin[0:lim])
+// parseArgon2 read the parameters, salt and key of an argon2id / argon2i PHC string
+func parseArgon2(hashed string) (variant string, params Argon2Params, salt, key []byte, err error) {
+	parts := strings.Split(hashed, "$")
+	if len(parts) != 6 || parts[0] != "" {
+		err = errors.New("invalid argon2 hash, unexpected number of fields")
+		return
 	}
-
-	// add more crap to the string willy-nilly
-	for i := len(m.pass); i > 0; i >>= 1 {
-		if (i & 1) == 1 {
-			initText.WriteByte(byte(0))
-		} else {
-			initText.WriteByte(m.pass[0])
-		}
+	variant = parts[1]
+	if variant != "argon2id" && variant != "argon2i" {
+		err = errors.New("unsupported argon2 variant " + variant)
+		return
 	}
-
-	// Begin our hashing in earnest using our initial string
-	h := md5.Sum(initText.Bytes())
-
-	n := bytes.NewBuffer([]byte{})
-
-	for i := 0; i < 1000; i++ {
-		// prepare to make a new muddle
-		n.Reset()
-
-		// alternate password+crap+bin with bin+crap+password
-		if (i & 1) == 1 {
-			n.Write(m.pass)
-		} else {
-			n.Write(h[:])
-		}
-
-		// usually add the salt, but not always
-		if i%3 != 0 {
-			n.Write(m.salt)
-		}
-
-		// usually add the password but not always
-		if i%7 != 0 {
-			n.Write(m.pass)
-		}
-
-		// the back half of that alternation
-		if (i & 1) == 1 {
-			n.Write(h[:])
-		} else {
-			n.Write(m.pass)
-		}
-
-		// replace bin with the md5 of this muddle
-		h = md5.Sum(n.Bytes())
+	var version int
+	if _, err = fmt.Sscanf(parts[2], "v=%d", &version); err != nil {
+		return
 	}
-
-	// At this point we stop transliterating the PHP code and flip back to
-	// reading the Apache source. The PHP uses their base64 library, but that
-	// uses the wrong character set so needs to be repaired afterwards and reversed
-	// and it is just really weird to read.
-
-	result := bytes.NewBuffer([]byte{})
-
-	// This is our own little similar-to-base64-but-not-quite filler
-	fill := func(a byte, b byte, c byte) {
-		v := (uint(a) << 16) + (uint(b) << 8) + uint(c) // take our 24 input bits
-
-		for i := 0; i < 4; i++ { // and pump out a character for each 6 bits
-			result.WriteByte("./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"[v&0x3f])
-			v >>= 6
-		}
+	if version != argon2.Version {
+		err = fmt.Errorf("unsupported argon2 version %d", version)
+		return
 	}
-
-	// The order of these indices is strange, be careful
-	fill(h[0], h[6], h[12])
-	fill(h[1], h[7], h[13])
-	fill(h[2], h[8], h[14])
-	fill(h[3], h[9], h[15])
-	fill(h[4], h[10], h[5]) // 5?  Yes.
-	fill(0, 0, h[11])
-
-	return result.Bytes()[0:22] // we wrote two extras since we only need 22.
-}
-
-func (d *md5Apr) Write(p []byte) (nn int, err error) {
-	d.pass = p
-	return len(p), nil
-}
-
-func (d *md5Apr) Reset() {
-	// Should we regenerate the salt here?
-	d.pass = d.pass[:0]
-}
-
-func (d *md5Apr) Size() int { return Size }
-
-// This is unimplemented and needs further analysis so we panic if anybody tries to use it
-func (d *md5Apr) BlockSize() int { panic("BlockSize is currently not implemented") }
-
-func (d0 *md5Apr) Sum(in []byte) []byte {
-	// Make a copy of d0 so that caller can keep writing and summing.
-	d := *d0
-	hash := d.checksum()
-	return append(in, hash[:]...)
+	if _, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Time, &params.Threads); err != nil {
+		return
+	}
+	if salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return
+	}
+	if key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil {
+		return
+	}
+	// argon2 panics on parameters it cannot work with
+	if params.Time < 1 || params.Threads < 1 || params.Memory < 8*uint32(params.Threads) {
+		err = errors.New("invalid argon2 hash, unusable parameters")
+		return
+	}
+	if len(salt) == 0 || len(key) == 0 {
+		err = errors.New("invalid argon2 hash, empty salt or key")
+		return
+	}
+	params.SaltLength = uint32(len(salt))
+	params.KeyLength = uint32(len(key))
+	return
 }
 
-// Sum returns the MD5 APR1 checksum of the data.
-func Sum(data []byte) []byte {
-	var d md5Apr
-	d.Reset()
-	d.Write(data)
-	return d.checksum()
+func verifyArgon2(password, hashed string) bool {
+	variant, params, salt, key, err := parseArgon2(hashed)
+	if err != nil {
+		return false
+	}
+	var computed []byte
+	if variant == "argon2id" {
+		computed = argon2.IDKey([]byte(password), salt, params.Time, params.Memory, params.Threads, params.KeyLength)
+	} else {
+		computed = argon2.Key([]byte(password), salt, params.Time, params.Memory, params.Threads, params.KeyLength)
+	}
+	return subtle.ConstantTimeCompare(computed, key) == 1
 }
 
-func hashSha(password string) string {
-	s := sha1.New()
-	s.Write([]byte(password))
-	passwordSum := []byte(s.Sum(nil))
-	return base64.StdEncoding.EncodeToString(passwordSum)
+// randomSalt n random characters of the crypt alphabet
+func randomSalt(n int) ([]byte, error) {
+	bs := make([]byte, n)
+	if _, err := io.ReadFull(rand.Reader, bs); err != nil {
+		return nil, err
+	}
+	for i, b := range bs {
+		bs[i] = crypt64[b&0x3f]
+	}
+	return bs, nil
 }
 
-func hashBcrypt(password string) (hash string, err error) {
-	passwordBytes, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
-	if err != nil {
-		return
-	}
-	return string(passwordBytes), nil
+func constantTimeEquals(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
 }
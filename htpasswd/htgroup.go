@@ -0,0 +1,180 @@
+package htpasswd
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+)
+
+// HtGroups group => users, the format of Apache's AuthGroupFile
+type HtGroups map[string][]string
+
+const (
+	// GroupSeparator separates the group name from its members
+	GroupSeparator = ":"
+	// MemberSeparator separates the members of a group
+	MemberSeparator = " "
+)
+
+// ParseHtgroupFile load a htgroup file
+func ParseHtgroupFile(file string) (groups HtGroups, err error) {
+	htgroupBytes, err := ioutil.ReadFile(file)
+	if err != nil {
+		return
+	}
+	if len(htgroupBytes) > MaxHtpasswdFilesize {
+		err = errors.New("this file is too large, use a database instead")
+		return
+	}
+	return ParseHtgroup(htgroupBytes)
+}
+
+// ParseHtgroup parse htgroup bytes, a group defined on several lines gets the members of all of them
+func ParseHtgroup(htgroupBytes []byte) (groups HtGroups, err error) {
+	lines := strings.Split(string(htgroupBytes), LineSeparator)
+	groups = HtGroups{}
+	for lineNumber, line := range lines {
+		line = strings.TrimSpace(line)
+		if len(line) == 0 || strings.HasPrefix(line, CommentPrefix) {
+			continue
+		}
+		i := strings.Index(line, GroupSeparator)
+		if i <= 0 {
+			err = fmt.Errorf("invalid line %d, expected \"group: user1 user2\" in \"%s\"", lineNumber+1, line)
+			return
+		}
+		group := strings.TrimSpace(line[:i])
+		for _, user := range strings.Fields(line[i+1:]) {
+			groups.AddUser(group, user)
+		}
+		if _, ok := groups[group]; !ok {
+			groups[group] = []string{}
+		}
+	}
+	return
+}
+
+// Bytes bytes representation, groups are sorted by name
+func (g HtGroups) Bytes() []byte {
+	htgroupBytes := []byte{}
+	for _, group := range g.Names() {
+		htgroupBytes = append(htgroupBytes, []byte(group+GroupSeparator+" "+strings.Join(g[group], MemberSeparator)+LineSeparator)...)
+	}
+	return htgroupBytes
+}
+
+// WriteToFile put them to a file, the file is replaced atomically and keeps its mode
+func (g HtGroups) WriteToFile(file string) error {
+	return writeFileAtomic(file, g.Bytes(), 0644)
+}
+
+// Names sorted group names
+func (g HtGroups) Names() []string {
+	names := make([]string, 0, len(g))
+	for name := range g {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// AddUser add a user to a group, the group is created if necessary
+func (g HtGroups) AddUser(group, user string) {
+	if g.IsMember(user, group) {
+		return
+	}
+	g[group] = append(g[group], user)
+}
+
+// RemoveUser remove a user from a group, returns false if the user was not a member
+func (g HtGroups) RemoveUser(group, user string) bool {
+	members := g[group]
+	for i, member := range members {
+		if member == user {
+			g[group] = append(members[:i:i], members[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// RemoveUserFromAll remove a user from every group, for example after deleting it from the htpasswd file
+func (g HtGroups) RemoveUserFromAll(user string) {
+	for group := range g {
+		g.RemoveUser(group, user)
+	}
+}
+
+// IsMember tell if user is a member of group
+func (g HtGroups) IsMember(user, group string) bool {
+	for _, member := range g[group] {
+		if member == user {
+			return true
+		}
+	}
+	return false
+}
+
+// IsMemberOfAny tell if user is a member of at least one of the groups
+func (g HtGroups) IsMemberOfAny(user string, groups ...string) bool {
+	for _, group := range groups {
+		if g.IsMember(user, group) {
+			return true
+		}
+	}
+	return false
+}
+
+// GroupsOf sorted names of the groups user is a member of
+func (g HtGroups) GroupsOf(user string) []string {
+	groups := []string{}
+	for _, group := range g.Names() {
+		if g.IsMember(user, group) {
+			groups = append(groups, group)
+		}
+	}
+	return groups
+}
+
+// AddUserToGroup add a user to a group in a htgroup file, the file is created if it does not exist
+func AddUserToGroup(file, group, user string) error {
+	return updateHtgroupFile(file, func(groups HtGroups) error {
+		groups.AddUser(group, user)
+		return nil
+	})
+}
+
+// RemoveUserFromGroup remove a user from a group in a htgroup file, returns an error if the user
+// was not a member
+func RemoveUserFromGroup(file, group, user string) error {
+	return updateHtgroupFile(file, func(groups HtGroups) error {
+		if !groups.RemoveUser(group, user) {
+			return errors.New("user was not a member of group " + group)
+		}
+		return nil
+	})
+}
+
+// updateHtgroupFile a read-modify-write under the same lock file as a Store
+func updateHtgroupFile(file string, fn func(groups HtGroups) error) error {
+	unlock, err := lockPath(file, true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	groups, err := ParseHtgroupFile(file)
+	if os.IsNotExist(err) {
+		groups, err = HtGroups{}, nil
+	}
+	if err != nil {
+		return err
+	}
+	err = fn(groups)
+	if err != nil {
+		return err
+	}
+	return groups.WriteToFile(file)
+}
@@ -5,7 +5,11 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"sort"
 	"strings"
+
+	"golang.org/x/crypto/bcrypt"
 )
 
 // HashedPasswords name => hash
@@ -20,9 +24,35 @@ const (
 	// HashSHA sha5 insecure - do not use
 	HashSHA = "sha"
 
+	// HashMD5 MD5 APR1 $apr1$, htpasswd -m - insecure
 	HashMD5 = "md5"
+	// HashMD5Crypt MD5-crypt $1$ of crypt(3) - insecure
+	HashMD5Crypt = "md5-crypt"
+	// HashSHA256 SHA-256-crypt $5$, htpasswd -2
+	HashSHA256 = "sha256"
+	// HashSHA512 SHA-512-crypt $6$, htpasswd -5
+	HashSHA512 = "sha512"
+	// HashArgon2 argon2id in PHC string format - recommended
+	HashArgon2 = "argon2id"
 )
 
+// HashOptions cost parameters for the hashing algorithms
+type HashOptions struct {
+	// BcryptCost see golang.org/x/crypto/bcrypt
+	BcryptCost int
+	// ShaCryptRounds rounds for HashSHA256 and HashSHA512, zero means ShaCryptDefaultRounds
+	ShaCryptRounds int
+	// Argon2 parameters for HashArgon2
+	Argon2 Argon2Params
+}
+
+// DefaultHashOptions used by SetPassword
+var DefaultHashOptions = HashOptions{
+	BcryptCost:     bcrypt.DefaultCost,
+	ShaCryptRounds: ShaCryptDefaultRounds,
+	Argon2:         DefaultArgon2Params,
+}
+
 const (
 	// PasswordSeparator separates passwords from hashes
 	PasswordSeparator = ":"
@@ -33,41 +63,166 @@ const (
 // MaxHtpasswdFilesize if your htpassd file is larger than 8MB, then your are doing it wrong
 const MaxHtpasswdFilesize = 8 * 1024 * 1024 * 1024
 
-// Bytes bytes representation
+// Bytes bytes representation, users are sorted by name
 func (hp HashedPasswords) Bytes() (passwordBytes []byte) {
 	passwordBytes = []byte{}
-	for name, hash := range hp {
-		passwordBytes = append(passwordBytes, []byte(name+PasswordSeparator+hash+LineSeparator)...)
+	for _, name := range hp.Names() {
+		passwordBytes = append(passwordBytes, []byte(name+PasswordSeparator+hp[name]+LineSeparator)...)
 	}
 	return passwordBytes
 }
 
-// WriteToFile put them to a file will be overwritten or created
+// Names sorted user names
+func (hp HashedPasswords) Names() []string {
+	names := make([]string, 0, len(hp))
+	for name := range hp {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// WriteToFile put them to a file will be overwritten or created, the file is replaced atomically
+// and keeps its mode
 func (hp HashedPasswords) WriteToFile(file string) error {
-	return ioutil.WriteFile(file, hp.Bytes(), 0644)
+	return writeFileAtomic(file, hp.Bytes(), 0644)
+}
+
+// writeFileAtomic write to a temporary file next to file and rename it, perm is only used if file
+// does not exist yet
+func writeFileAtomic(file string, data []byte, perm os.FileMode) error {
+	if info, err := os.Stat(file); err == nil {
+		perm = info.Mode().Perm()
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(file), "."+filepath.Base(file)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(data); err == nil {
+		err = tmp.Sync()
+	}
+	if err == nil {
+		err = tmp.Chmod(perm)
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmp.Name(), file)
+	if err != nil {
+		return err
+	}
+	// make the rename itself durable
+	if dir, err := os.Open(filepath.Dir(file)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+	return nil
 }
 
 // SetPassword set a password for a user with a hashing algo
 func (hp HashedPasswords) SetPassword(name, password string, hashAlgorithm HashAlgorithm) (err error) {
-	if len(password) == 0 {
-		return errors.New("passwords must not be empty, if you want to delete a user call RemoveUser")
+	return hp.SetPasswordWithOptions(name, password, hashAlgorithm, DefaultHashOptions)
+}
+
+// SetPasswordWithOptions set a password for a user with a hashing algo and explicit cost parameters,
+// the password must satisfy DefaultPasswordPolicy
+func (hp HashedPasswords) SetPasswordWithOptions(name, password string, hashAlgorithm HashAlgorithm, options HashOptions) (err error) {
+	return hp.SetPasswordWithPolicy(name, password, hashAlgorithm, options, DefaultPasswordPolicy)
+}
+
+// SetPasswordWithPolicy set a password for a user that must satisfy policy, errors of the policy
+// are *PolicyError
+func (hp HashedPasswords) SetPasswordWithPolicy(name, password string, hashAlgorithm HashAlgorithm, options HashOptions, policy PasswordPolicy) (err error) {
+	current := hp[name]
+	err = policy.Check(name, password, current)
+	if err != nil {
+		return err
+	}
+	hash, err := HashPassword(password, hashAlgorithm, options)
+	if err != nil {
+		return err
+	}
+	hp[name] = hash
+	if policy.History != nil && len(current) > 0 {
+		policy.History.Add(name, current)
 	}
-	hash := ""
-	prefix := ""
+	return nil
+}
+
+// Verify check the password of a user, unknown users never verify
+func (hp HashedPasswords) Verify(name, password string) bool {
+	hash, ok := hp[name]
+	if !ok {
+		return false
+	}
+	return CheckPassword(password, hash)
+}
+
+// HashPassword hash a password with the given algorithm, the result is a complete htpasswd hash
+// including the scheme prefix
+func HashPassword(password string, hashAlgorithm HashAlgorithm, options HashOptions) (hash string, err error) {
 	switch hashAlgorithm {
 	case HashBCrypt:
-		hash, err = hashBcrypt(password)
+		return hashBcrypt(password, options.BcryptCost)
 	case HashSHA:
-		prefix = "{SHA}"
-		hash = hashSha(password)
+		return "{SHA}" + hashSha(password), nil
 	case HashMD5:
-		hash = hashMd5(password)
+		return hashMd5(password)
+	case HashMD5Crypt:
+		return hashMd5Crypt(password)
+	case HashSHA256:
+		return hashSha256Crypt(password, options.ShaCryptRounds)
+	case HashSHA512:
+		return hashSha512Crypt(password, options.ShaCryptRounds)
+	case HashArgon2:
+		return hashArgon2(password, options.Argon2)
 	}
-	if err != nil {
-		return err
+	return "", errors.New("unknown hash algorithm " + string(hashAlgorithm))
+}
+
+// IdentifyHash tell the algorithm of a htpasswd hash by its prefix, returns an empty
+// HashAlgorithm for unknown schemes
+func IdentifyHash(hash string) HashAlgorithm {
+	switch {
+	case strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"), strings.HasPrefix(hash, "$2y$"):
+		return HashBCrypt
+	case strings.HasPrefix(hash, "{SHA}"):
+		return HashSHA
+	case strings.HasPrefix(hash, apr1Magic):
+		return HashMD5
+	case strings.HasPrefix(hash, md5CryptMagic):
+		return HashMD5Crypt
+	case strings.HasPrefix(hash, "$5$"):
+		return HashSHA256
+	case strings.HasPrefix(hash, "$6$"):
+		return HashSHA512
+	case strings.HasPrefix(hash, "$argon2id$"), strings.HasPrefix(hash, "$argon2i$"):
+		return HashArgon2
 	}
-	hp[name] = prefix + hash
-	return nil
+	return ""
+}
+
+// CheckPassword reports whether password matches hash, all schemes known to IdentifyHash are supported
+func CheckPassword(password, hash string) bool {
+	switch IdentifyHash(hash) {
+	case HashBCrypt:
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+	case HashSHA:
+		return constantTimeEquals("{SHA}"+hashSha(password), hash)
+	case HashMD5, HashMD5Crypt:
+		return verifyMd5(password, hash)
+	case HashSHA256:
+		return sha256Crypt.verify(password, hash)
+	case HashSHA512:
+		return sha512Crypt.verify(password, hash)
+	case HashArgon2:
+		return verifyArgon2(password, hash)
+	}
+	return false
 }
 
 // ParseHtpasswdFile load a htpasswd file
@@ -90,8 +245,8 @@ func ParseHtpasswd(htpasswdBytes []byte) (passwords HashedPasswords, err error)
 	for lineNumber, line := range lines {
 		// scan lines
 		line = strings.Trim(line, " ")
-		if len(line) == 0 {
-			// skipping empty lines
+		if len(line) == 0 || strings.HasPrefix(line, CommentPrefix) {
+			// skipping empty lines and comments
 			continue
 		}
 		parts := strings.Split(line, PasswordSeparator)
@@ -114,55 +269,24 @@ func ParseHtpasswd(htpasswdBytes []byte) (passwords HashedPasswords, err error)
 
 // SetHtpasswdHash set password hash for a user
 func SetHtpasswdHash(file, name, hash string) error {
-	passwords, err := ParseHtpasswdFile(file)
-	if err != nil {
-		return err
-	}
-	passwords[name] = hash
-	return passwords.WriteToFile(file)
+	return NewStore(file).Update(func(passwords HashedPasswords) error {
+		passwords[name] = hash
+		return nil
+	})
 }
 
 // RemoveUser remove an existing user from a file, returns an error, if the user does not \
 // exist in the file
 func RemoveUser(file, user string) error {
-	passwords, err := ParseHtpasswdFile(file)
-	if err != nil {
-		return err
-	}
-	_, ok := passwords[user]
-	if !ok {
-		return errors.New("user did not exist in file")
-	}
-	delete(passwords, user)
-	return passwords.WriteToFile(file)
+	return NewStore(file).RemoveUser(user)
 }
 
 // SetPasswordHash directly set a hash for a user in a file
 func SetPasswordHash(file, user, hash string) error {
-	if len(hash) == 0 {
-		return errors.New("you might want to rethink your hashing algorithm, it left you with an empty hash")
-	}
-	passwords, err := ParseHtpasswdFile(file)
-	if err != nil {
-		return err
-	}
-	passwords[user] = hash
-	return passwords.WriteToFile(file)
+	return NewStore(file).SetPasswordHash(user, hash)
 }
 
 // SetPassword set password for a user with a given hashing algorithm
 func SetPassword(file, name, password string, hashAlgorithm HashAlgorithm) error {
-	_, err := os.Stat(file)
-	passwords := HashedPasswords(map[string]string{})
-	if err == nil {
-		passwords, err = ParseHtpasswdFile(file)
-		if err != nil {
-			return err
-		}
-	}
-	err = passwords.SetPassword(name, password, hashAlgorithm)
-	if err != nil {
-		return err
-	}
-	return passwords.WriteToFile(file)
+	return NewStore(file).SetPassword(name, password, hashAlgorithm)
 }
@@ -1,8 +1,17 @@
 package htpasswd
 
 import (
+	"errors"
+	"fmt"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func poe(err error) {
@@ -11,9 +20,12 @@ func poe(err error) {
 	}
 }
 
-func tFile(name string) string {
-	f, err := ioutil.TempFile("./", "test."+name+"")
+// tFile an empty file in the temporary directory of the test, lock files and sidecars end up
+// next to it and are removed with it
+func tFile(t *testing.T, name string) string {
+	f, err := ioutil.TempFile(t.TempDir(), "test."+name)
 	poe(err)
+	poe(f.Close())
 	return f.Name()
 }
 
@@ -25,14 +37,14 @@ func fileContentsAre(t *testing.T, file string, contents string) {
 	}
 }
 func TestEmptyHtpasswdFile(t *testing.T) {
-	f := tFile("empty")
+	f := tFile(t, "empty")
 	SetPassword(f, "sha", "sha", HashSHA)
 	SetPassword(f, "a", "a", HashBCrypt)
 	SetPassword(f, "b", "b", HashMD5)
 	//fileContentsAre(t, f, "sha:{SHA}2PRZAyDhNDqRW2OUFwZQqPNdaSY=\n")
 }
 func TestSetPasswordHash(t *testing.T) {
-	f := tFile("set-hashes")
+	f := tFile(t, "set-hashes")
 
 	poe(SetPasswordHash(f, "a", "a"))
 	poe(SetPasswordHash(f, "b", "b"))
@@ -50,3 +62,558 @@ func TestSetPasswordHash(t *testing.T) {
 		t.Fatal("c failed")
 	}
 }
+
+func TestShaCryptVectors(t *testing.T) {
+	// test vectors from https://www.akkadia.org/drepper/SHA-crypt.txt
+	vectors := map[string]string{
+		"$5$saltstring$5B8vYYiY.CVt1RlTTf8KbXBH3hsxY/GNooZaBBGWEc5":                                                               "Hello world!",
+		"$5$rounds=10000$saltstringsaltst$3xv.VbSHBb41AL9AvLeujZkZRBAwqFMz2.opqey6IcA":                                            "Hello world!",
+		"$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1":                    "Hello world!",
+		"$6$rounds=10000$saltstringsaltst$OW1/O6BYHV6BcXZu8QVeXbDWra3Oeqh0sbHbbMCVNSnCM/UrjmM0Dp8vOuZeHBy/YTBmSK6H9qs/y3RnOaw5v.": "Hello world!",
+	}
+	for hash, password := range vectors {
+		if !CheckPassword(password, hash) {
+			t.Fatal("failed to verify", hash)
+		}
+		if CheckPassword(password+"!", hash) {
+			t.Fatal("wrong password verified for", hash)
+		}
+	}
+}
+
+func TestHashAlgorithms(t *testing.T) {
+	passwords := HashedPasswords{}
+	options := DefaultHashOptions
+	options.BcryptCost = 5
+	options.ShaCryptRounds = 2000
+	options.Argon2.Memory = 1024
+	algorithms := []HashAlgorithm{HashBCrypt, HashSHA, HashMD5, HashSHA256, HashSHA512, HashArgon2}
+	for _, algorithm := range algorithms {
+		poe(passwords.SetPasswordWithOptions(string(algorithm), "secret", algorithm, options))
+	}
+	for _, algorithm := range algorithms {
+		name := string(algorithm)
+		if IdentifyHash(passwords[name]) != algorithm {
+			t.Fatal("unexpected algorithm for", passwords[name])
+		}
+		if !passwords.Verify(name, "secret") {
+			t.Fatal("failed to verify", name, passwords[name])
+		}
+		if passwords.Verify(name, "wrong") {
+			t.Fatal("wrong password verified for", name)
+		}
+	}
+	if !strings.HasPrefix(passwords[HashSHA512], "$6$rounds=2000$") {
+		t.Fatal("rounds missing in", passwords[HashSHA512])
+	}
+	if !strings.HasPrefix(passwords[HashBCrypt], "$2a$05$") {
+		t.Fatal("cost missing in", passwords[HashBCrypt])
+	}
+	if passwords.Verify("unknown", "secret") {
+		t.Fatal("unknown user verified")
+	}
+}
+
+func TestShaCryptDefaults(t *testing.T) {
+	for _, algorithm := range []HashAlgorithm{HashSHA256, HashSHA512} {
+		hash, err := HashPassword("x", algorithm, HashOptions{})
+		poe(err)
+		if strings.Contains(hash, "rounds=") || !CheckPassword("x", hash) {
+			t.Fatal("default rounds not used", hash)
+		}
+		hash, err = HashPassword("x", algorithm, HashOptions{ShaCryptRounds: 4000})
+		poe(err)
+		if !(RehashPolicy{Algorithm: algorithm}).NeedsRehash(hash) {
+			t.Fatal("fewer rounds than the default kept", hash)
+		}
+	}
+}
+
+func TestArgon2Defaults(t *testing.T) {
+	hash, err := HashPassword("x", HashArgon2, HashOptions{BcryptCost: 10})
+	poe(err)
+	if !strings.HasPrefix(hash, "$argon2id$v=19$m=65536,t=1,p=4$") || !CheckPassword("x", hash) {
+		t.Fatal("default parameters not used", hash)
+	}
+	malformed := []string{
+		"$argon2id$v=19$m=16,t=1,p=1$c2FsdHNhbHQ$",
+		"$argon2id$v=19$m=16,t=1,p=1$$c2FsdHNhbHQ",
+		"$argon2id$v=19$m=16,t=0,p=1$c2FsdHNhbHQ$c2FsdHNhbHQ",
+		"$argon2id$v=19$m=16,t=1,p=0$c2FsdHNhbHQ$c2FsdHNhbHQ",
+		"$argon2id$v=19$m=4,t=1,p=1$c2FsdHNhbHQ$c2FsdHNhbHQ",
+	}
+	for _, hash := range malformed {
+		if CheckPassword("", hash) {
+			t.Fatal("malformed hash verified", hash)
+		}
+	}
+}
+
+func TestVerifyAndUpgrade(t *testing.T) {
+	f := tFile(t, "upgrade")
+	poe(SetPassword(f, "sha", "sha", HashSHA))
+	poe(SetPassword(f, "md5", "md5", HashMD5))
+	policy := DefaultRehashPolicy
+	policy.Options.BcryptCost = 5
+	migrated := []string{}
+	policy.OnUpgrade = func(name string, from, to HashAlgorithm) {
+		migrated = append(migrated, name+":"+string(from)+">"+string(to))
+	}
+	ok, err := VerifyAndUpgrade(f, "sha", "wrong", policy)
+	poe(err)
+	if ok || len(migrated) != 0 {
+		t.Fatal("wrong password must neither verify nor upgrade")
+	}
+	ok, err = VerifyAndUpgrade(f, "sha", "sha", policy)
+	poe(err)
+	if !ok || len(migrated) != 1 || migrated[0] != "sha:sha>bcrypt" {
+		t.Fatal("sha was not upgraded", migrated)
+	}
+	passwords, err := ParseHtpasswdFile(f)
+	poe(err)
+	if IdentifyHash(passwords["sha"]) != HashBCrypt || IdentifyHash(passwords["md5"]) != HashMD5 {
+		t.Fatal("unexpected hashes after upgrade", passwords)
+	}
+	ok, err = VerifyAndUpgrade(f, "sha", "sha", policy)
+	poe(err)
+	if !ok || len(migrated) != 1 {
+		t.Fatal("bcrypt hash must not be upgraded again", migrated)
+	}
+	policy.Options.BcryptCost = 6
+	if !policy.NeedsRehash(passwords["sha"]) {
+		t.Fatal("bcrypt cost below the minimum must be upgraded")
+	}
+}
+
+func TestStoreConcurrentUpdates(t *testing.T) {
+	f := tFile(t, "store")
+	poe(os.Chmod(f, 0640))
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			// separate stores only share the lock file
+			poe(NewStore(f).SetPasswordHash(fmt.Sprint("user", i), fmt.Sprint("hash", i)))
+		}(i)
+	}
+	wg.Wait()
+	passwords, err := NewStore(f).Read()
+	poe(err)
+	if len(passwords) != 20 {
+		t.Fatal("lost updates, expected 20 users got", len(passwords))
+	}
+	info, err := os.Stat(f)
+	poe(err)
+	if info.Mode().Perm() != 0640 {
+		t.Fatal("file mode was not preserved", info.Mode())
+	}
+	if NewStore(f).RemoveUser("unknown") == nil {
+		t.Fatal("removing an unknown user must fail")
+	}
+}
+
+func TestStoreLockDir(t *testing.T) {
+	dir, lockDir := t.TempDir(), t.TempDir()
+	f := filepath.Join(dir, "passwords")
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			store := NewStore(f)
+			store.SetLockDir(lockDir)
+			poe(store.SetPasswordHash(fmt.Sprint("user", i), fmt.Sprint("hash", i)))
+		}(i)
+	}
+	wg.Wait()
+	store := NewStore(f)
+	store.SetLockDir(lockDir)
+	passwords, err := store.Read()
+	poe(err)
+	if len(passwords) != 10 {
+		t.Fatal("lost updates, expected 10 users got", len(passwords))
+	}
+	if _, err = os.Stat(filepath.Join(lockDir, "passwords"+LockSuffix)); err != nil {
+		t.Fatal("lock file missing in the lock dir", err)
+	}
+	if _, err = os.Stat(f + LockSuffix); !os.IsNotExist(err) {
+		t.Fatal("lock file must not be created next to the file", err)
+	}
+}
+
+func TestDocumentPreservesLayout(t *testing.T) {
+	f := tFile(t, "document")
+	original := "# admins\nroot:a\n\n# users\nzoe : z\nbroken line\nbob:b\n"
+	poe(ioutil.WriteFile(f, []byte(original), 0644))
+	passwords, err := ParseHtpasswdFile(f)
+	if err == nil {
+		t.Fatal("unknown lines must still be rejected by ParseHtpasswdFile", passwords)
+	}
+	store := NewStore(f)
+	poe(store.SetPasswordHash("zoe", "z2"))
+	poe(store.SetPasswordHash("carl", "c"))
+	poe(store.SetPasswordHash("anna", "a"))
+	poe(store.RemoveUser("bob"))
+	fileContentsAre(t, f, "# admins\nroot:a\n\n# users\nzoe:z2\nbroken line\ncarl:c\nanna:a\n")
+	doc, err := ParseDocumentFile(f)
+	poe(err)
+	if strings.Join(doc.Users(), ",") != "root,zoe,carl,anna" {
+		t.Fatal("unexpected user order", doc.Users())
+	}
+	if hash, ok := doc.Get("zoe"); !ok || hash != "z2" {
+		t.Fatal("unexpected hash for zoe", hash)
+	}
+	for _, malformed := range []string{"zoe:z:extra\n", ":z\n", "root:a\nzoe : z : x\n"} {
+		if _, err = ParseDocument([]byte(malformed)); err == nil {
+			t.Fatal("malformed user line accepted", malformed)
+		}
+	}
+	poe(ioutil.WriteFile(f, []byte("zoe:z:extra\n"), 0644))
+	if NewStore(f).SetPasswordHash("zoe", "z2") == nil {
+		t.Fatal("a malformed user line must not be duplicated")
+	}
+	fileContentsAre(t, f, "zoe:z:extra\n")
+	if string(HashedPasswords{"b": "2", "a": "1"}.Bytes()) != "a:1\nb:2\n" {
+		t.Fatal("users must be written sorted")
+	}
+}
+
+func TestHtgroup(t *testing.T) {
+	f := tFile(t, "htgroup")
+	poe(ioutil.WriteFile(f, []byte("# groups\nadmin: root anna\nusers: anna bob\nadmin: carl\n"), 0644))
+	groups, err := ParseHtgroupFile(f)
+	poe(err)
+	if !groups.IsMember("carl", "admin") || groups.IsMember("bob", "admin") {
+		t.Fatal("unexpected members", groups)
+	}
+	if strings.Join(groups.GroupsOf("anna"), ",") != "admin,users" {
+		t.Fatal("unexpected groups of anna", groups.GroupsOf("anna"))
+	}
+	poe(AddUserToGroup(f, "users", "carl"))
+	poe(RemoveUserFromGroup(f, "admin", "anna"))
+	if RemoveUserFromGroup(f, "admin", "bob") == nil {
+		t.Fatal("removing a non member must fail")
+	}
+	fileContentsAre(t, f, "admin: root carl\nusers: anna bob carl\n")
+	if _, err := os.Stat(f + LockSuffix); err != nil {
+		t.Fatal("htgroup changes must take the lock of the file", err)
+	}
+}
+
+func TestGroupMiddleware(t *testing.T) {
+	passwords := NewStore(tFile(t, "middleware"))
+	poe(passwords.SetPasswordHash("root", "{SHA}"+hashSha("root")))
+	poe(passwords.SetPasswordHash("bob", "{SHA}"+hashSha("bob")))
+	groups := HtGroups{"admin": {"root"}}
+	handler := BasicAuth("test", passwords)(RequireGroups(groups,
+		GroupRule{Prefix: "/admin", Groups: []string{"admin"}},
+		GroupRule{Prefix: "/admin/public", Groups: []string{"admin", "users"}},
+	)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name, _ := UserFromContext(r.Context())
+		w.Write([]byte(name))
+	})))
+	for _, c := range []struct {
+		user, password, path string
+		status               int
+	}{
+		{"", "", "/", http.StatusUnauthorized},
+		{"bob", "wrong", "/", http.StatusUnauthorized},
+		{"bob", "bob", "/", http.StatusOK},
+		{"bob", "bob", "/admin/", http.StatusForbidden},
+		{"root", "root", "/admin/", http.StatusOK},
+		{"root", "root", "/admin/public", http.StatusOK},
+		{"bob", "bob", "/admin", http.StatusForbidden},
+		{"bob", "bob", "/public/../admin/x", http.StatusForbidden},
+		{"bob", "bob", "//admin", http.StatusForbidden},
+		{"bob", "bob", "/administrator", http.StatusOK},
+	} {
+		r := httptest.NewRequest("GET", c.path, nil)
+		if c.user != "" {
+			r.SetBasicAuth(c.user, c.password)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != c.status {
+			t.Fatal("unexpected status", w.Code, "for", c)
+		}
+	}
+}
+
+func TestGroupRulePrefixes(t *testing.T) {
+	passwords := NewStore(tFile(t, "prefixes"))
+	poe(passwords.SetPasswordHash("bob", "{SHA}"+hashSha("bob")))
+	groups := HtGroups{"admin": {"root"}}
+	handler := BasicAuth("test", passwords)(RequireGroups(groups,
+		GroupRule{Prefix: "/admin//", Groups: []string{"admin"}},
+		GroupRule{Prefix: "/admin/../secret", Groups: []string{"admin"}},
+	)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+	for _, c := range []struct {
+		path   string
+		status int
+	}{
+		{"/admin", http.StatusForbidden},
+		{"/admin/x", http.StatusForbidden},
+		{"/secret/x", http.StatusForbidden},
+		{"/public", http.StatusOK},
+	} {
+		r := httptest.NewRequest("GET", c.path, nil)
+		r.SetBasicAuth("bob", "bob")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != c.status {
+			t.Fatal("unexpected status", w.Code, "for", c.path)
+		}
+	}
+	defer func() {
+		if recover() == nil {
+			t.Fatal("a prefix without a leading slash must be rejected")
+		}
+	}()
+	RequireGroups(groups, GroupRule{Prefix: "admin", Groups: []string{"admin"}})
+}
+
+func TestCredentialStores(t *testing.T) {
+	boltStore, err := OpenBoltStore(tFile(t, "bolt"), time.Second)
+	poe(err)
+	defer boltStore.Close()
+	stores := map[string]CredentialStore{
+		"file":   NewStore(tFile(t, "backend")),
+		"memory": NewMemoryStore(nil),
+		"bolt":   boltStore,
+	}
+	for kind, store := range stores {
+		poe(store.SetPassword("a", "a", HashSHA))
+		poe(store.SetPasswordHash("b", "{SHA}"+hashSha("b")))
+		poe(store.RemoveUser("a"))
+		if store.RemoveUser("a") == nil {
+			t.Fatal(kind, "removing an unknown user must fail")
+		}
+		if ok, err := store.Verify("b", "b"); err != nil || !ok {
+			t.Fatal(kind, "failed to verify b", err)
+		}
+		dummyHashOnce, dummyHash = sync.Once{}, ""
+		if ok, _ := store.Verify("a", "a"); ok {
+			t.Fatal(kind, "removed user verified")
+		}
+		if dummyHash == "" {
+			t.Fatal(kind, "unknown users must spend the time of a password check")
+		}
+	}
+	source := NewMemoryStore(HashedPasswords{"x": "1", "y": "2"})
+	n, err := Migrate(source, stores["bolt"])
+	poe(err)
+	passwords, err := stores["bolt"].Read()
+	poe(err)
+	if n != 2 || len(passwords) != 3 || passwords["x"] != "1" {
+		t.Fatal("unexpected users after migration", n, passwords)
+	}
+}
+
+func TestPasswordPolicy(t *testing.T) {
+	breached := tFile(t, "breached")
+	// SHA-1 of "Password1!"
+	poe(ioutil.WriteFile(breached, []byte("0000000000000000000000000000000000000000:1\n32CA9FC1A0F5B6330E3F4C8C1BBECDE9BEDB9573:42\n"), 0644))
+	policy := PasswordPolicy{
+		MinLength:           8,
+		MinCharacterClasses: 3,
+		RejectUsername:      true,
+		History:             NewPasswordHistory(2),
+		Breached:            NewBreachedPasswords(breached),
+	}
+	options := DefaultHashOptions
+	options.BcryptCost = 4
+	passwords := HashedPasswords{}
+	for password, rule := range map[string]string{
+		"":             RuleEmpty,
+		"Ab1!":         RuleMinLength,
+		"abcdefgh1":    RuleCharacterClasses,
+		"xAliceX1!":    RuleUsername,
+		"xecilaX1!":    RuleUsername,
+		"Password1!":   RuleBreached,
+		"Correct1Hor!": "",
+	} {
+		err := passwords.SetPasswordWithPolicy("alice", password, HashBCrypt, options, policy)
+		var policyErr *PolicyError
+		if rule == "" && err != nil {
+			t.Fatal("unexpected error", err)
+		}
+		if rule != "" && (!errors.As(err, &policyErr) || policyErr.Rule != rule) {
+			t.Fatal("expected rule", rule, "for", password, "got", err)
+		}
+	}
+	poe(passwords.SetPasswordWithPolicy("alice", "Second2Hor!", HashBCrypt, options, policy))
+	for _, password := range []string{"Correct1Hor!", "Second2Hor!"} {
+		err := passwords.SetPasswordWithPolicy("alice", password, HashBCrypt, options, policy)
+		var policyErr *PolicyError
+		if !errors.As(err, &policyErr) || policyErr.Rule != RuleReuse {
+			t.Fatal("reuse of", password, "must be rejected, got", err)
+		}
+	}
+	// the zero policy allows keeping the current password
+	poe(passwords.SetPasswordWithPolicy("alice", "Second2Hor!", HashBCrypt, options, PasswordPolicy{}))
+	err := passwords.SetPasswordWithPolicy("alice", "Second2Hor!", HashBCrypt, options, PasswordPolicy{DisallowReuse: true})
+	if policyErr := (*PolicyError)(nil); !errors.As(err, &policyErr) || policyErr.Rule != RuleReuse {
+		t.Fatal("reuse of the current password must be rejected, got", err)
+	}
+	history, err := ParsePasswordHistory(policy.History.Bytes(), 2)
+	poe(err)
+	if len(history.Previous("alice")) != 1 {
+		t.Fatal("unexpected history", string(policy.History.Bytes()))
+	}
+}
+
+func TestPasswordHistorySize(t *testing.T) {
+	history := &PasswordHistory{Size: 2}
+	for _, hash := range []string{"a", "b", "c"} {
+		history.Add("alice", hash)
+	}
+	if previous := history.Previous("alice"); len(previous) != 2 || previous[0] != "b" {
+		t.Fatal("unexpected history", previous)
+	}
+	for _, size := range []int{0, -1} {
+		history = &PasswordHistory{Size: size}
+		history.Add("alice", "a")
+		if previous := history.Previous("alice"); len(previous) != 0 {
+			t.Fatal("a history of size", size, "must keep nothing", previous)
+		}
+	}
+}
+
+func TestStoreMetadata(t *testing.T) {
+	f := tFile(t, "metadata")
+	store := NewStoreWithMetadata(f, AccountPolicy{MaxFailedAttempts: 2, MaxInactivity: time.Hour})
+	poe(store.SetPassword("a", "a", HashSHA))
+	poe(store.SetPassword("b", "b", HashSHA))
+	metadata, err := store.Metadata()
+	poe(err)
+	if metadata["a"] == nil || metadata["a"].Created.IsZero() || metadata["a"].Changed.IsZero() {
+		t.Fatal("missing timestamps", metadata["a"])
+	}
+	for i := 0; i < 2; i++ {
+		if store.Authenticate("a", "wrong") != ErrInvalidCredentials {
+			t.Fatal("wrong password must fail")
+		}
+	}
+	if err = store.Authenticate("a", "a"); err != ErrAccountLocked {
+		t.Fatal("account must be locked, got", err)
+	}
+	poe(store.Unlock("a"))
+	poe(store.Authenticate("a", "a"))
+	poe(store.SetDisabled("a", true))
+	if ok, err := store.Verify("a", "a"); err != nil || ok {
+		t.Fatal("disabled account verified", err)
+	}
+	poe(store.SetExpiry("b", time.Now().Add(-time.Minute)))
+	if err = store.Authenticate("b", "b"); err != ErrAccountExpired {
+		t.Fatal("account must be expired, got", err)
+	}
+	poe(store.UpdateMetadata("b", func(user *UserMetadata) error {
+		user.Expires = time.Time{}
+		user.LastLogin = time.Now().Add(-2 * time.Hour)
+		return nil
+	}))
+	if err = store.Authenticate("b", "b"); err != ErrAccountInactive {
+		t.Fatal("account must be inactive, got", err)
+	}
+	poe(store.RemoveUser("b"))
+	metadata, err = store.Metadata()
+	poe(err)
+	if _, ok := metadata["b"]; ok {
+		t.Fatal("metadata of removed users must be dropped")
+	}
+	if err = store.Authenticate("unknown", "a"); err != ErrInvalidCredentials {
+		t.Fatal("unknown users must fail like wrong passwords, got", err)
+	}
+
+	// without tracking logins a successful login leaves the metadata alone
+	untracked := NewStoreWithMetadata(f, AccountPolicy{})
+	poe(store.SetDisabled("a", false))
+	before, err := ioutil.ReadFile(f + MetadataSuffix)
+	poe(err)
+	poe(untracked.Authenticate("a", "a"))
+	if after, _ := ioutil.ReadFile(f + MetadataSuffix); string(before) != string(after) {
+		t.Fatal("untracked login must not write the metadata", string(after))
+	}
+	if strings.Contains(string(before), "expires") || strings.Contains(string(before), "lockedUntil") {
+		t.Fatal("zero times must be left out", string(before))
+	}
+	metadata, err = ParseMetadataFile(f + MetadataSuffix)
+	poe(err)
+	if metadata["a"].Created.IsZero() || !metadata["a"].Expires.IsZero() || metadata["a"].LastLogin.IsZero() {
+		t.Fatal("metadata did not survive a round trip", metadata["a"])
+	}
+}
+
+func TestStoreLockout(t *testing.T) {
+	store := NewStoreWithMetadata(tFile(t, "lockout"), AccountPolicy{MaxFailedAttempts: 2, LockoutDuration: 50 * time.Millisecond})
+	poe(store.SetPassword("a", "a", HashSHA))
+	for i := 0; i < 2; i++ {
+		if store.Authenticate("a", "wrong") != ErrInvalidCredentials {
+			t.Fatal("wrong password must fail")
+		}
+	}
+	if err := store.Authenticate("a", "wrong"); err != ErrInvalidCredentials {
+		t.Fatal("the lockout must not be revealed without the password, got", err)
+	}
+	if err := store.Authenticate("a", "a"); err != ErrAccountLocked {
+		t.Fatal("account must be locked, got", err)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if store.Authenticate("a", "wrong") != ErrInvalidCredentials {
+		t.Fatal("wrong password must fail")
+	}
+	if err := store.Authenticate("a", "a"); err != nil {
+		t.Fatal("one failure after the lockout must not lock again, got", err)
+	}
+	poe(store.SetDisabled("a", true))
+	if err := store.Authenticate("a", "wrong"); err != ErrInvalidCredentials {
+		t.Fatal("a disabled account must not be revealed without the password, got", err)
+	}
+}
+
+func TestMd5CryptVectors(t *testing.T) {
+	// generated with openssl passwd -apr1 / -1, -apr1 is the output of Apache's htpasswd -m
+	vectors := map[string]string{
+		"$apr1$Zo3yz3F1$2U0oLI7Np8pWDkAA5uAHW/": "password",
+		"$apr1$rEkt/2Hh$/R0/LXwQNCnOV.4WP0bVE1": "myPassword",
+		"$apr1$x$WA5XFCUz/GeRB0EqPLhGh.":        "a very long password that exceeds sixteen bytes",
+		"$1$saltsalt$qjXMvbEw8oaL.CzflDtaK/":    "password",
+		"$1$ab$rn6aQS/o7141mj179E/zA.":          "",
+	}
+	for hash, password := range vectors {
+		if !CheckPassword(password, hash) {
+			t.Fatal("failed to verify", hash)
+		}
+		if CheckPassword(password+"x", hash) {
+			t.Fatal("wrong password verified for", hash)
+		}
+	}
+	if string(Sum([]byte("password"), []byte("Zo3yz3F1"))) != "2U0oLI7Np8pWDkAA5uAHW/" {
+		t.Fatal("unexpected checksum")
+	}
+}
+
+func TestMd5HashInterface(t *testing.T) {
+	h := FromSalt([]byte("rEkt/2Hh"))
+	h.Write([]byte("my"))
+	h.Write([]byte("Password"))
+	if string(h.Sum(nil)) != "/R0/LXwQNCnOV.4WP0bVE1" {
+		t.Fatal("writes must append", string(h.Sum(nil)))
+	}
+	// summing must not change the state
+	if string(h.Sum([]byte("x"))) != "x/R0/LXwQNCnOV.4WP0bVE1" {
+		t.Fatal("unexpected second sum")
+	}
+	h.Reset()
+	h.Write([]byte("myPassword"))
+	if string(h.Sum(nil)) != "/R0/LXwQNCnOV.4WP0bVE1" || h.BlockSize() != 64 || h.Size() != Size {
+		t.Fatal("reset must keep the salt")
+	}
+	random, err := New()
+	poe(err)
+	random.Write([]byte("a"))
+	if len(random.Sum(nil)) != Size {
+		t.Fatal("unexpected checksum size")
+	}
+}
@@ -0,0 +1,15 @@
+//go:build !unix
+
+package htpasswd
+
+import "os"
+
+// lockFile advisory file locks are only available on unix, other platforms only get the
+// in process locking of the Store
+func lockFile(f *os.File, exclusive bool) error {
+	return nil
+}
+
+func unlockFile(f *os.File) error {
+	return nil
+}
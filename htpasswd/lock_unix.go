@@ -0,0 +1,26 @@
+//go:build unix
+
+package htpasswd
+
+import (
+	"os"
+	"syscall"
+)
+
+// lockFile take an advisory flock on f, exclusive for writers
+func lockFile(f *os.File, exclusive bool) error {
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+	for {
+		err := syscall.Flock(int(f.Fd()), how)
+		if err != syscall.EINTR {
+			return err
+		}
+	}
+}
+
+func unlockFile(f *os.File) error {
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+}
@@ -0,0 +1,231 @@
+package htpasswd
+
+import (
+	"bytes"
+	"crypto/md5"
+	"hash"
+	"strings"
+)
+
+// MD5-crypt as implemented by Apache's apr_md5_encode, the $apr1$ scheme of htpasswd -m and the
+// $1$ scheme of crypt(3) only differ in their magic prefix.
+
+// The size of an MD% APR Salt
+const PW_SALT_BYTES = 8
+
+// The size of an MD5 APR1 checksum in bytes.
+const Size = 22
+
+const (
+	apr1Magic     = "$apr1$"
+	md5CryptMagic = "$1$"
+)
+
+type md5Apr struct {
+	magic string
+	salt  []byte
+	pass  []byte
+}
+
+var _ hash.Hash = &md5Apr{}
+
+// New returns a new md5Apr1 hash computing the MD5Apr1 checksum based on a randomly generated salt
+func New() (hash.Hash, error) {
+	salt, err := generateSalt()
+	if err != nil {
+		return nil, err
+	}
+	return FromSalt(salt), nil
+}
+
+// FromSalt returns a new md5Apr1 hash computing the MD5Apr1 checksum based on a fixed salt value
+// Take care to pass a randomly generated salt if using this
+func FromSalt(salt []byte) hash.Hash {
+	return newMd5Crypt(apr1Magic, salt)
+}
+
+// NewMD5Crypt returns a new hash computing the checksum of the $1$ MD5-crypt scheme of crypt(3)
+// based on a fixed salt value
+func NewMD5Crypt(salt []byte) hash.Hash {
+	return newMd5Crypt(md5CryptMagic, salt)
+}
+
+// newMd5Crypt the salt is used up to the first $ and at most PW_SALT_BYTES characters
+func newMd5Crypt(magic string, salt []byte) *md5Apr {
+	if i := bytes.IndexByte(salt, '$'); i >= 0 {
+		salt = salt[:i]
+	}
+	if len(salt) > PW_SALT_BYTES {
+		salt = salt[:PW_SALT_BYTES]
+	}
+	return &md5Apr{
+		magic: magic,
+		salt:  append([]byte{}, salt...),
+	}
+}
+
+// generateSalt PW_SALT_BYTES random characters of the crypt alphabet
+func generateSalt() ([]byte, error) {
+	return randomSalt(PW_SALT_BYTES)
+}
+
+func hashMd5(password string) (string, error) {
+	salt, err := generateSalt()
+	if err != nil {
+		return "", err
+	}
+	return md5Crypt(apr1Magic, []byte(password), salt), nil
+}
+
+func hashMd5Crypt(password string) (string, error) {
+	salt, err := generateSalt()
+	if err != nil {
+		return "", err
+	}
+	return md5Crypt(md5CryptMagic, []byte(password), salt), nil
+}
+
+// md5Crypt the complete hash including magic and salt
+func md5Crypt(magic string, password, salt []byte) string {
+	m := newMd5Crypt(magic, salt)
+	m.Write(password)
+	return magic + string(m.salt) + "$" + string(m.checksum())
+}
+
+// verifyMd5 check $apr1$ and $1$ hashes
+func verifyMd5(password, hashed string) bool {
+	magic := apr1Magic
+	if !strings.HasPrefix(hashed, magic) {
+		magic = md5CryptMagic
+		if !strings.HasPrefix(hashed, magic) {
+			return false
+		}
+	}
+	salt := hashed[len(magic):]
+	i := strings.Index(salt, "$")
+	if i < 0 {
+		return false
+	}
+	return constantTimeEquals(md5Crypt(magic, []byte(password), []byte(salt[:i])), hashed)
+}
+
+func (m *md5Apr) checksum() []byte {
+
+	bin := make([]byte, len(m.pass))
+	text := make([]byte, len(m.pass))
+
+	copy(bin, m.pass)
+	copy(text, m.pass)
+
+	bin = append(bin, m.salt...)
+	bin = append(bin, m.pass...)
+
+	// start with a hash of password and salt
+	initBin := md5.Sum(bin)
+
+	text = append(text, m.magic...)
+	text = append(text, m.salt...)
+	// begin an initial string with hash and salt
+	initText := bytes.NewBuffer(text)
+
+	// add crap to the string willy-nilly
+	for i := len(m.pass); i > 0; i -= 16 {
+		lim := i
+		if lim > 16 {
+			lim = 16
+		}
+		initText.Write(initBin[0:lim])
+	}
+
+	// add more crap to the string willy-nilly
+	for i := len(m.pass); i > 0; i >>= 1 {
+		if (i & 1) == 1 {
+			initText.WriteByte(byte(0))
+		} else {
+			initText.WriteByte(m.pass[0])
+		}
+	}
+
+	// Begin our hashing in earnest using our initial string
+	h := md5.Sum(initText.Bytes())
+
+	n := bytes.NewBuffer([]byte{})
+
+	for i := 0; i < 1000; i++ {
+		// prepare to make a new muddle
+		n.Reset()
+
+		// alternate password+crap+bin with bin+crap+password
+		if (i & 1) == 1 {
+			n.Write(m.pass)
+		} else {
+			n.Write(h[:])
+		}
+
+		// usually add the salt, but not always
+		if i%3 != 0 {
+			n.Write(m.salt)
+		}
+
+		// usually add the password but not always
+		if i%7 != 0 {
+			n.Write(m.pass)
+		}
+
+		// the back half of that alternation
+		if (i & 1) == 1 {
+			n.Write(h[:])
+		} else {
+			n.Write(m.pass)
+		}
+
+		// replace bin with the md5 of this muddle
+		h = md5.Sum(n.Bytes())
+	}
+
+	// At this point we stop transliterating the PHP code and flip back to
+	// reading the Apache source. The PHP uses their base64 library, but that
+	// uses the wrong character set so needs to be repaired afterwards and reversed
+	// and it is just really weird to read.
+
+	result := bytes.NewBuffer([]byte{})
+
+	// The order of these indices is strange, be careful
+	crypt64Encode(result, h[0], h[6], h[12], 4)
+	crypt64Encode(result, h[1], h[7], h[13], 4)
+	crypt64Encode(result, h[2], h[8], h[14], 4)
+	crypt64Encode(result, h[3], h[9], h[15], 4)
+	crypt64Encode(result, h[4], h[10], h[5], 4) // 5?  Yes.
+	crypt64Encode(result, 0, 0, h[11], 2)
+
+	return result.Bytes()
+}
+
+// Write appends the password, like any hash.Hash
+func (d *md5Apr) Write(p []byte) (nn int, err error) {
+	d.pass = append(d.pass, p...)
+	return len(p), nil
+}
+
+// Reset forgets the password written so far, the salt is kept
+func (d *md5Apr) Reset() {
+	d.pass = nil
+}
+
+func (d *md5Apr) Size() int { return Size }
+
+// BlockSize the block size of the underlying MD5
+func (d *md5Apr) BlockSize() int { return md5.BlockSize }
+
+func (d0 *md5Apr) Sum(in []byte) []byte {
+	// checksum does not modify d0 so that caller can keep writing and summing.
+	hash := d0.checksum()
+	return append(in, hash[:]...)
+}
+
+// Sum returns the MD5 APR1 checksum of the data with the given salt.
+func Sum(data, salt []byte) []byte {
+	d := newMd5Crypt(apr1Magic, salt)
+	d.Write(data)
+	return d.checksum()
+}
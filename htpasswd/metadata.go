@@ -0,0 +1,238 @@
+package htpasswd
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// MetadataSuffix is appended to the htpasswd file name for the metadata sidecar file
+const MetadataSuffix = ".meta"
+
+// errors of Store.Authenticate
+var (
+	ErrInvalidCredentials = errors.New("invalid user name or password")
+	ErrAccountDisabled    = errors.New("account is disabled")
+	ErrAccountExpired     = errors.New("account is expired")
+	ErrAccountLocked      = errors.New("account is locked after too many failed attempts")
+	ErrAccountInactive    = errors.New("account was inactive for too long")
+	ErrPasswordExpired    = errors.New("password is expired")
+)
+
+// UserMetadata what a htpasswd line cannot express about a user, zero times are unknown or never
+type UserMetadata struct {
+	Created        time.Time
+	Changed        time.Time
+	Expires        time.Time
+	Disabled       bool
+	FailedAttempts int
+	LastFailure    time.Time
+	LastLogin      time.Time
+	// Locked until it is unlocked explicitly
+	Locked      bool
+	LockedUntil time.Time
+}
+
+// jsonUserMetadata the stored form of UserMetadata, zero times are left out
+type jsonUserMetadata struct {
+	Created        *time.Time `json:"created,omitempty"`
+	Changed        *time.Time `json:"changed,omitempty"`
+	Expires        *time.Time `json:"expires,omitempty"`
+	Disabled       bool       `json:"disabled,omitempty"`
+	FailedAttempts int        `json:"failedAttempts,omitempty"`
+	LastFailure    *time.Time `json:"lastFailure,omitempty"`
+	LastLogin      *time.Time `json:"lastLogin,omitempty"`
+	Locked         bool       `json:"locked,omitempty"`
+	LockedUntil    *time.Time `json:"lockedUntil,omitempty"`
+}
+
+// MarshalJSON implements json.Marshaler
+func (m UserMetadata) MarshalJSON() ([]byte, error) {
+	return json.Marshal(jsonUserMetadata{
+		Created:        optionalTime(m.Created),
+		Changed:        optionalTime(m.Changed),
+		Expires:        optionalTime(m.Expires),
+		Disabled:       m.Disabled,
+		FailedAttempts: m.FailedAttempts,
+		LastFailure:    optionalTime(m.LastFailure),
+		LastLogin:      optionalTime(m.LastLogin),
+		Locked:         m.Locked,
+		LockedUntil:    optionalTime(m.LockedUntil),
+	})
+}
+
+// UnmarshalJSON implements json.Unmarshaler
+func (m *UserMetadata) UnmarshalJSON(data []byte) error {
+	var stored jsonUserMetadata
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return err
+	}
+	*m = UserMetadata{
+		Created:        requiredTime(stored.Created),
+		Changed:        requiredTime(stored.Changed),
+		Expires:        requiredTime(stored.Expires),
+		Disabled:       stored.Disabled,
+		FailedAttempts: stored.FailedAttempts,
+		LastFailure:    requiredTime(stored.LastFailure),
+		LastLogin:      requiredTime(stored.LastLogin),
+		Locked:         stored.Locked,
+		LockedUntil:    requiredTime(stored.LockedUntil),
+	}
+	return nil
+}
+
+func optionalTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+func requiredTime(t *time.Time) time.Time {
+	if t == nil {
+		return time.Time{}
+	}
+	return *t
+}
+
+// Metadata name => metadata, stored as JSON next to the htpasswd file
+type Metadata map[string]*UserMetadata
+
+// AccountPolicy rules Store.Authenticate applies to the metadata, zero values disable a rule
+type AccountPolicy struct {
+	// MaxFailedAttempts lock an account after this many failed attempts in a row
+	MaxFailedAttempts int
+	// LockoutDuration how long an account stays locked, 0 locks it until Store.Unlock
+	LockoutDuration time.Duration
+	// MaxPasswordAge reject passwords older than this
+	MaxPasswordAge time.Duration
+	// MaxInactivity reject accounts that did not log in for this long, implies RecordLastLogin
+	MaxInactivity time.Duration
+	// RecordLastLogin keep LastLogin up to date, this writes the metadata file on every login
+	RecordLastLogin bool
+}
+
+// recordsLastLogin tell if successful logins are written to the metadata
+func (p AccountPolicy) recordsLastLogin() bool {
+	return p.RecordLastLogin || p.MaxInactivity > 0
+}
+
+// check the state of an account at now
+func (p AccountPolicy) check(m *UserMetadata, now time.Time) error {
+	switch {
+	case m.Disabled:
+		return ErrAccountDisabled
+	case !m.Expires.IsZero() && now.After(m.Expires):
+		return ErrAccountExpired
+	case m.Locked || now.Before(m.LockedUntil):
+		return ErrAccountLocked
+	case p.MaxPasswordAge > 0 && !m.Changed.IsZero() && now.Sub(m.Changed) > p.MaxPasswordAge:
+		return ErrPasswordExpired
+	}
+	if p.MaxInactivity > 0 {
+		last := m.LastLogin
+		if last.IsZero() {
+			last = m.Changed
+		}
+		if !last.IsZero() && now.Sub(last) > p.MaxInactivity {
+			return ErrAccountInactive
+		}
+	}
+	return nil
+}
+
+// fail record a failed attempt and lock the account if there were too many
+func (p AccountPolicy) fail(m *UserMetadata, now time.Time) {
+	m.FailedAttempts++
+	m.LastFailure = now
+	if p.MaxFailedAttempts > 0 && m.FailedAttempts >= p.MaxFailedAttempts {
+		if p.LockoutDuration > 0 {
+			m.LockedUntil = now.Add(p.LockoutDuration)
+		} else {
+			m.Locked = true
+		}
+	}
+}
+
+var (
+	dummyHashOnce sync.Once
+	dummyHash     string
+)
+
+// verifyUnknownUser spend the time of checking a bcrypt hash, so that unknown users cannot be
+// told apart from wrong passwords by the response time
+func verifyUnknownUser(password string) {
+	dummyHashOnce.Do(func() {
+		dummyHash, _ = HashPassword("dummy", HashBCrypt, DefaultHashOptions)
+	})
+	CheckPassword(password, dummyHash)
+}
+
+// ParseMetadataFile load a metadata file, a missing file has no metadata
+func ParseMetadataFile(file string) (Metadata, error) {
+	metadataBytes, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return Metadata{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	metadata := Metadata{}
+	if len(metadataBytes) == 0 {
+		return metadata, nil
+	}
+	err = json.Unmarshal(metadataBytes, &metadata)
+	return metadata, err
+}
+
+// Bytes JSON representation, users are sorted by name
+func (m Metadata) Bytes() ([]byte, error) {
+	metadataBytes, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(metadataBytes, LineSeparator...), nil
+}
+
+// WriteToFile put the metadata to a file, the file is replaced atomically and keeps its mode
+func (m Metadata) WriteToFile(file string) error {
+	metadataBytes, err := m.Bytes()
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(file, metadataBytes, 0600)
+}
+
+// user the metadata of a user, created if missing
+func (m Metadata) user(name string) *UserMetadata {
+	user, ok := m[name]
+	if !ok || user == nil {
+		user = &UserMetadata{}
+		m[name] = user
+	}
+	return user
+}
+
+// track update the timestamps of users whose hashes changed between before and after and drop
+// removed users
+func (m Metadata) track(before, after HashedPasswords, now time.Time) {
+	for name := range m {
+		if _, ok := after[name]; !ok {
+			delete(m, name)
+		}
+	}
+	for name, hash := range after {
+		old, existed := before[name]
+		if existed && old == hash {
+			continue
+		}
+		user := m.user(name)
+		if !existed || user.Created.IsZero() {
+			user.Created = now
+		}
+		user.Changed = now
+	}
+}
@@ -0,0 +1,96 @@
+package htpasswd
+
+import (
+	"context"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// Verifier checks the credentials of a user, Store is a Verifier
+type Verifier interface {
+	Verify(name, password string) (bool, error)
+}
+
+type contextKey string
+
+const userContextKey contextKey = "htpasswd-user"
+
+// UserFromContext the name of the user authenticated by BasicAuth
+func UserFromContext(ctx context.Context) (name string, ok bool) {
+	name, ok = ctx.Value(userContextKey).(string)
+	return
+}
+
+// BasicAuth http middleware that requires HTTP basic authentication against verifier, the
+// authenticated user is available through UserFromContext
+func BasicAuth(realm string, verifier Verifier) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			name, password, ok := r.BasicAuth()
+			if ok {
+				ok, err := verifier.Verify(name, password)
+				if err != nil {
+					http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+					return
+				}
+				if ok {
+					next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), userContextKey, name)))
+					return
+				}
+			}
+			w.Header().Set("WWW-Authenticate", `Basic realm="`+strings.Replace(realm, `"`, `'`, -1)+`"`)
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		})
+	}
+}
+
+// GroupRule only members of one of the Groups may access URL paths starting with Prefix
+type GroupRule struct {
+	Prefix string
+	Groups []string
+}
+
+// RequireGroups http middleware authorizing users authenticated by BasicAuth by their groups, the
+// rule with the longest matching prefix applies and paths without a rule are open to every
+// authenticated user. Prefixes are cleaned like request paths, it panics on a prefix that does
+// not start with a slash since that rule would never match.
+func RequireGroups(groups HtGroups, rules ...GroupRule) func(http.Handler) http.Handler {
+	rules = append([]GroupRule(nil), rules...)
+	for i := range rules {
+		if !strings.HasPrefix(rules[i].Prefix, "/") {
+			panic("htpasswd: group rule prefix " + strconv.Quote(rules[i].Prefix) + " must start with /")
+		}
+		rules[i].Prefix = path.Clean(rules[i].Prefix)
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			name, ok := UserFromContext(r.Context())
+			if !ok {
+				http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+				return
+			}
+			rule := matchGroupRule(rules, r.URL.Path)
+			if rule != nil && !groups.IsMemberOfAny(name, rule.Groups...) {
+				http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// matchGroupRule the rule with the longest prefix that matches the cleaned path on segment
+// boundaries, /admin matches /admin/x but not /administrator. The prefixes are already cleaned.
+func matchGroupRule(rules []GroupRule, p string) (match *GroupRule) {
+	p = path.Clean("/" + p)
+	for i, rule := range rules {
+		prefix := strings.TrimSuffix(rule.Prefix, "/")
+		matches := p == prefix || strings.HasPrefix(p, prefix+"/")
+		if matches && (match == nil || len(rule.Prefix) > len(match.Prefix)) {
+			match = &rules[i]
+		}
+	}
+	return
+}
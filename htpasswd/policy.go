@@ -0,0 +1,250 @@
+package htpasswd
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// rules of a PasswordPolicy reported by PolicyError
+const (
+	RuleEmpty            = "empty"
+	RuleMinLength        = "min-length"
+	RuleCharacterClasses = "character-classes"
+	RuleUsername         = "username"
+	RuleReuse            = "reuse"
+	RuleBreached         = "breached"
+)
+
+// PolicyError a password was rejected by a rule of a PasswordPolicy
+type PolicyError struct {
+	Rule    string
+	Message string
+}
+
+func (e *PolicyError) Error() string { return "password rejected (" + e.Rule + "): " + e.Message }
+
+// PasswordPolicy rules enforced when setting a password, the zero value only rejects empty passwords
+type PasswordPolicy struct {
+	// MinLength minimum number of characters
+	MinLength int
+	// MinCharacterClasses minimum number of lower case, upper case, digit and other characters classes
+	MinCharacterClasses int
+	// RejectUsername reject passwords containing the user name or its reverse, ignoring case
+	RejectUsername bool
+	// DisallowReuse reject the current password of the user
+	DisallowReuse bool
+	// History previous hashes of users, the current and the previous hashes must not match the new
+	// password, new hashes are recorded
+	History *PasswordHistory
+	// Breached list of breached passwords
+	Breached *BreachedPasswords
+}
+
+// DefaultPasswordPolicy enforced by SetPassword
+var DefaultPasswordPolicy = PasswordPolicy{}
+
+// Check password for user name, current is the hash the user has now and may be empty
+func (p PasswordPolicy) Check(name, password, current string) error {
+	if len(password) == 0 {
+		return &PolicyError{RuleEmpty, "passwords must not be empty, if you want to delete a user call RemoveUser"}
+	}
+	if n := len([]rune(password)); n < p.MinLength {
+		return &PolicyError{RuleMinLength, fmt.Sprintf("password has %d characters, at least %d are required", n, p.MinLength)}
+	}
+	if n := characterClasses(password); n < p.MinCharacterClasses {
+		return &PolicyError{RuleCharacterClasses, fmt.Sprintf("password uses %d character classes, at least %d are required", n, p.MinCharacterClasses)}
+	}
+	if p.RejectUsername && len(name) > 0 {
+		lower := strings.ToLower(password)
+		lowerName := strings.ToLower(name)
+		if strings.Contains(lower, lowerName) || strings.Contains(lower, reverse(lowerName)) {
+			return &PolicyError{RuleUsername, "password must not contain the user name"}
+		}
+	}
+	if (p.DisallowReuse || p.History != nil) && len(current) > 0 && CheckPassword(password, current) {
+		return &PolicyError{RuleReuse, "password must differ from the current password"}
+	}
+	if p.History != nil {
+		for _, hash := range p.History.Previous(name) {
+			if CheckPassword(password, hash) {
+				return &PolicyError{RuleReuse, "password was used before"}
+			}
+		}
+	}
+	if p.Breached != nil {
+		breached, err := p.Breached.Contains(password)
+		if err != nil {
+			return err
+		}
+		if breached {
+			return &PolicyError{RuleBreached, "password appears in a list of breached passwords"}
+		}
+	}
+	return nil
+}
+
+func characterClasses(password string) int {
+	var lower, upper, digit, other int
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = 1
+		case unicode.IsUpper(r):
+			upper = 1
+		case unicode.IsDigit(r):
+			digit = 1
+		default:
+			other = 1
+		}
+	}
+	return lower + upper + digit + other
+}
+
+func reverse(s string) string {
+	runes := []rune(s)
+	for i, j := 0, len(runes)-1; i < j; i, j = i+1, j-1 {
+		runes[i], runes[j] = runes[j], runes[i]
+	}
+	return string(runes)
+}
+
+// PasswordHistory previous hashes of users, it is safe for concurrent use and written in the
+// htpasswd format with one line per previous hash
+type PasswordHistory struct {
+	// Size number of hashes kept per user, the zero value keeps nothing
+	Size     int
+	mu       sync.RWMutex
+	previous map[string][]string
+}
+
+// NewPasswordHistory a history keeping size hashes per user
+func NewPasswordHistory(size int) *PasswordHistory {
+	return &PasswordHistory{Size: size, previous: map[string][]string{}}
+}
+
+// ParsePasswordHistory parse name:hash lines, the most recent hash of a user comes last
+func ParsePasswordHistory(historyBytes []byte, size int) (*PasswordHistory, error) {
+	h := NewPasswordHistory(size)
+	for lineNumber, raw := range strings.Split(string(historyBytes), LineSeparator) {
+		line := parseLine(raw)
+		switch line.Kind {
+		case LineUser:
+			h.Add(line.Name, line.Hash)
+		case LineUnknown:
+			return nil, fmt.Errorf("invalid history line %d", lineNumber+1)
+		}
+	}
+	return h, nil
+}
+
+// Add record a hash of a user, only the most recent Size hashes are kept and none if Size is not
+// positive
+func (h *PasswordHistory) Add(name, hash string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.Size <= 0 {
+		return
+	}
+	if h.previous == nil {
+		h.previous = map[string][]string{}
+	}
+	previous := append(h.previous[name], hash)
+	if len(previous) > h.Size {
+		previous = previous[len(previous)-h.Size:]
+	}
+	h.previous[name] = previous
+}
+
+// Previous hashes of a user, oldest first
+func (h *PasswordHistory) Previous(name string) []string {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return append([]string{}, h.previous[name]...)
+}
+
+// Remove forget the history of a user
+func (h *PasswordHistory) Remove(name string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.previous, name)
+}
+
+// Bytes bytes representation, users are sorted by name
+func (h *PasswordHistory) Bytes() []byte {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	names := make([]string, 0, len(h.previous))
+	for name := range h.previous {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	historyBytes := []byte{}
+	for _, name := range names {
+		for _, hash := range h.previous[name] {
+			historyBytes = append(historyBytes, []byte(name+PasswordSeparator+hash+LineSeparator)...)
+		}
+	}
+	return historyBytes
+}
+
+// WriteToFile put the history to a file, the file is replaced atomically and keeps its mode
+func (h *PasswordHistory) WriteToFile(file string) error {
+	return writeFileAtomic(file, h.Bytes(), 0600)
+}
+
+// BreachedPasswords a local copy of a breached password list in the k-anonymity format of the
+// Pwned Passwords range API: either a directory with one file per 5 character SHA-1 prefix
+// holding "SUFFIX:COUNT" lines, or a single file with "SHA1:COUNT" lines
+type BreachedPasswords struct {
+	path string
+}
+
+// NewBreachedPasswords use the list at path, a file or a directory of range files
+func NewBreachedPasswords(path string) *BreachedPasswords {
+	return &BreachedPasswords{path: path}
+}
+
+// Contains tell if the password is in the list
+func (b *BreachedPasswords) Contains(password string) (bool, error) {
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	info, err := os.Stat(b.path)
+	if err != nil {
+		return false, err
+	}
+	if info.IsDir() {
+		found, err := containsHash(filepath.Join(b.path, hash[:5]), hash[5:])
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return found, err
+	}
+	return containsHash(b.path, hash)
+}
+
+func containsHash(file, hash string) (bool, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if i := strings.Index(line, PasswordSeparator); i >= 0 {
+			line = line[:i]
+		}
+		if strings.EqualFold(line, hash) {
+			return true, nil
+		}
+	}
+	return false, scanner.Err()
+}
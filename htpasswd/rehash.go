@@ -0,0 +1,92 @@
+package htpasswd
+
+import (
+	"golang.org/x/crypto/bcrypt"
+)
+
+// RehashPolicy decides which hashes are upgraded after a successful login
+type RehashPolicy struct {
+	// Algorithm preferred algorithm for upgraded hashes
+	Algorithm HashAlgorithm
+	// Options cost parameters for upgraded hashes, they are also the minimum cost a hash must have
+	Options HashOptions
+	// Allowed further algorithms that are kept as long as their cost is not below Options
+	Allowed []HashAlgorithm
+	// OnUpgrade is called for every user whose hash was replaced
+	OnUpgrade func(name string, from, to HashAlgorithm)
+}
+
+// DefaultRehashPolicy migrates everything to bcrypt
+var DefaultRehashPolicy = RehashPolicy{
+	Algorithm: HashBCrypt,
+	Options:   DefaultHashOptions,
+}
+
+// NeedsRehash reports whether hash uses a scheme or a cost below the policy
+func (p RehashPolicy) NeedsRehash(hash string) bool {
+	algorithm := IdentifyHash(hash)
+	if !p.allows(algorithm) {
+		return true
+	}
+	switch algorithm {
+	case HashBCrypt:
+		cost, err := bcrypt.Cost([]byte(hash))
+		return err != nil || cost < p.Options.BcryptCost
+	case HashSHA256:
+		rounds, _, _, err := parseShaCrypt(sha256Crypt.prefix, hash)
+		return err != nil || rounds < shaCryptRounds(p.Options.ShaCryptRounds)
+	case HashSHA512:
+		rounds, _, _, err := parseShaCrypt(sha512Crypt.prefix, hash)
+		return err != nil || rounds < shaCryptRounds(p.Options.ShaCryptRounds)
+	case HashArgon2:
+		variant, params, _, _, err := parseArgon2(hash)
+		return err != nil || variant != HashArgon2 ||
+			params.Time < p.Options.Argon2.Time ||
+			params.Memory < p.Options.Argon2.Memory ||
+			params.KeyLength < p.Options.Argon2.KeyLength
+	}
+	return false
+}
+
+func (p RehashPolicy) allows(algorithm HashAlgorithm) bool {
+	if algorithm == "" {
+		return false
+	}
+	if algorithm == p.Algorithm {
+		return true
+	}
+	for _, allowed := range p.Allowed {
+		if allowed == algorithm {
+			return true
+		}
+	}
+	return false
+}
+
+// VerifyAndUpgrade check the password of a user and re-hash it with the preferred algorithm of
+// the policy when the stored hash is too weak, upgraded tells if the map was changed
+func (hp HashedPasswords) VerifyAndUpgrade(name, password string, policy RehashPolicy) (ok, upgraded bool, err error) {
+	if !hp.Verify(name, password) {
+		return false, false, nil
+	}
+	old := hp[name]
+	if !policy.NeedsRehash(old) {
+		return true, false, nil
+	}
+	// no password policy here, the user did not choose a new password
+	hash, err := HashPassword(password, policy.Algorithm, policy.Options)
+	if err != nil {
+		return true, false, err
+	}
+	hp[name] = hash
+	if policy.OnUpgrade != nil {
+		policy.OnUpgrade(name, IdentifyHash(old), policy.Algorithm)
+	}
+	return true, true, nil
+}
+
+// VerifyAndUpgrade check the password of a user in a file, weak hashes are upgraded according
+// to the policy and the file is rewritten atomically
+func VerifyAndUpgrade(file, name, password string, policy RehashPolicy) (ok bool, err error) {
+	return NewStore(file).VerifyAndUpgrade(name, password, policy)
+}
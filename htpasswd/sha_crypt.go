@@ -0,0 +1,229 @@
+package htpasswd
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"errors"
+	"hash"
+	"strconv"
+	"strings"
+)
+
+// SHA-crypt as specified by Ulrich Drepper, the $5$ (SHA-256) and $6$ (SHA-512)
+// schemes understood by glibc crypt(3) and by Apache's htpasswd -2 / -5.
+// See https://www.akkadia.org/drepper/SHA-crypt.txt
+
+const (
+	// ShaCryptDefaultRounds number of rounds used when none are specified
+	ShaCryptDefaultRounds = 5000
+	// ShaCryptMinRounds smaller round counts are raised to this value
+	ShaCryptMinRounds = 1000
+	// ShaCryptMaxRounds larger round counts are lowered to this value
+	ShaCryptMaxRounds = 999999999
+	// shaCryptMaxSaltLength salts are truncated to 16 characters
+	shaCryptMaxSaltLength = 16
+
+	shaCryptRoundsPrefix = "rounds="
+)
+
+// crypt64 is the alphabet used by all crypt(3) style hashes
+const crypt64 = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// byte permutations used when encoding the final digest
+var sha256CryptOrder = [][3]int{
+	{0, 10, 20}, {21, 1, 11}, {12, 22, 2}, {3, 13, 23}, {24, 4, 14},
+	{15, 25, 5}, {6, 16, 26}, {27, 7, 17}, {18, 28, 8}, {9, 19, 29},
+}
+
+var sha512CryptOrder = [][3]int{
+	{0, 21, 42}, {22, 43, 1}, {44, 2, 23}, {3, 24, 45}, {25, 46, 4},
+	{47, 5, 26}, {6, 27, 48}, {28, 49, 7}, {50, 8, 29}, {9, 30, 51},
+	{31, 52, 10}, {53, 11, 32}, {12, 33, 54}, {34, 55, 13}, {56, 14, 35},
+	{15, 36, 57}, {37, 58, 16}, {59, 17, 38}, {18, 39, 60}, {40, 61, 19},
+	{62, 20, 41},
+}
+
+type shaCryptVariant struct {
+	prefix  string
+	newHash func() hash.Hash
+	order   [][3]int
+}
+
+var (
+	sha256Crypt = shaCryptVariant{prefix: "$5$", newHash: sha256.New, order: sha256CryptOrder}
+	sha512Crypt = shaCryptVariant{prefix: "$6$", newHash: sha512.New, order: sha512CryptOrder}
+)
+
+// shaCryptRounds rounds with zero taken as ShaCryptDefaultRounds
+func shaCryptRounds(rounds int) int {
+	if rounds == 0 {
+		return ShaCryptDefaultRounds
+	}
+	return rounds
+}
+
+func hashSha256Crypt(password string, rounds int) (string, error) {
+	rounds = shaCryptRounds(rounds)
+	salt, err := randomSalt(shaCryptMaxSaltLength)
+	if err != nil {
+		return "", err
+	}
+	return sha256Crypt.crypt([]byte(password), salt, rounds, rounds != ShaCryptDefaultRounds), nil
+}
+
+func hashSha512Crypt(password string, rounds int) (string, error) {
+	rounds = shaCryptRounds(rounds)
+	salt, err := randomSalt(shaCryptMaxSaltLength)
+	if err != nil {
+		return "", err
+	}
+	return sha512Crypt.crypt([]byte(password), salt, rounds, rounds != ShaCryptDefaultRounds), nil
+}
+
+// parseShaCrypt splits a $5$ / $6$ hash into its rounds, salt and whether the rounds
+// were given explicitly
+func parseShaCrypt(prefix, hashed string) (rounds int, explicitRounds bool, salt []byte, err error) {
+	if !strings.HasPrefix(hashed, prefix) {
+		err = errors.New("not a " + prefix + " hash")
+		return
+	}
+	rest := hashed[len(prefix):]
+	rounds = ShaCryptDefaultRounds
+	if strings.HasPrefix(rest, shaCryptRoundsPrefix) {
+		i := strings.Index(rest, "$")
+		if i < 0 {
+			err = errors.New("invalid " + prefix + " hash, missing salt")
+			return
+		}
+		rounds, err = strconv.Atoi(rest[len(shaCryptRoundsPrefix):i])
+		if err != nil {
+			err = errors.New("invalid " + prefix + " hash, bad rounds")
+			return
+		}
+		explicitRounds = true
+		rest = rest[i+1:]
+	}
+	// the salt ends at the next $ or at the end of the string
+	if i := strings.Index(rest, "$"); i >= 0 {
+		rest = rest[:i]
+	}
+	salt = []byte(rest)
+	return
+}
+
+func (v shaCryptVariant) verify(password, hashed string) bool {
+	rounds, explicit, salt, err := parseShaCrypt(v.prefix, hashed)
+	if err != nil {
+		return false
+	}
+	return constantTimeEquals(v.crypt([]byte(password), salt, rounds, explicit), hashed)
+}
+
+func (v shaCryptVariant) crypt(password, salt []byte, rounds int, explicitRounds bool) string {
+	if len(salt) > shaCryptMaxSaltLength {
+		salt = salt[:shaCryptMaxSaltLength]
+	}
+	if rounds < ShaCryptMinRounds {
+		rounds = ShaCryptMinRounds
+	}
+	if rounds > ShaCryptMaxRounds {
+		rounds = ShaCryptMaxRounds
+	}
+
+	// digest B = password + salt + password
+	b := v.newHash()
+	b.Write(password)
+	b.Write(salt)
+	b.Write(password)
+	sumB := b.Sum(nil)
+	size := len(sumB)
+
+	// digest A = password + salt + B for every byte of the password + the bits of its length
+	a := v.newHash()
+	a.Write(password)
+	a.Write(salt)
+	i := len(password)
+	for ; i > size; i -= size {
+		a.Write(sumB)
+	}
+	a.Write(sumB[:i])
+	for i = len(password); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			a.Write(sumB)
+		} else {
+			a.Write(password)
+		}
+	}
+	sumA := a.Sum(nil)
+
+	// byte sequence P derived from the password
+	dp := v.newHash()
+	for i = 0; i < len(password); i++ {
+		dp.Write(password)
+	}
+	p := repeatTo(dp.Sum(nil), len(password))
+
+	// byte sequence S derived from the salt
+	ds := v.newHash()
+	for i = 0; i < 16+int(sumA[0]); i++ {
+		ds.Write(salt)
+	}
+	s := repeatTo(ds.Sum(nil), len(salt))
+
+	c := sumA
+	for i = 0; i < rounds; i++ {
+		h := v.newHash()
+		if i&1 != 0 {
+			h.Write(p)
+		} else {
+			h.Write(c)
+		}
+		if i%3 != 0 {
+			h.Write(s)
+		}
+		if i%7 != 0 {
+			h.Write(p)
+		}
+		if i&1 != 0 {
+			h.Write(c)
+		} else {
+			h.Write(p)
+		}
+		c = h.Sum(nil)
+	}
+
+	out := bytes.NewBufferString(v.prefix)
+	if explicitRounds {
+		out.WriteString(shaCryptRoundsPrefix + strconv.Itoa(rounds) + "$")
+	}
+	out.Write(salt)
+	out.WriteByte('$')
+	for _, o := range v.order {
+		crypt64Encode(out, c[o[0]], c[o[1]], c[o[2]], 4)
+	}
+	if size == sha256.Size {
+		crypt64Encode(out, 0, c[31], c[30], 3)
+	} else {
+		crypt64Encode(out, 0, 0, c[63], 2)
+	}
+	return out.String()
+}
+
+// repeatTo fills a slice of length n by repeating sum
+func repeatTo(sum []byte, n int) []byte {
+	out := make([]byte, 0, n)
+	for len(out)+len(sum) < n {
+		out = append(out, sum...)
+	}
+	return append(out, sum[:n-len(out)]...)
+}
+
+// crypt64Encode writes n characters encoding the 24 bits of b2 b1 b0, least significant first
+func crypt64Encode(out *bytes.Buffer, b2, b1, b0 byte, n int) {
+	w := uint(b2)<<16 | uint(b1)<<8 | uint(b0)
+	for ; n > 0; n-- {
+		out.WriteByte(crypt64[w&0x3f])
+		w >>= 6
+	}
+}
@@ -0,0 +1,390 @@
+package htpasswd
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// LockSuffix is appended to the htpasswd file name for the lock file used by Store
+const LockSuffix = ".lock"
+
+// Store a htpasswd file that is safe for concurrent use by goroutines and, through an advisory
+// lock file, by other processes using a Store on the same file. Every change is a locked
+// read-modify-write that replaces the file atomically.
+//
+// The htpasswd file itself cannot be locked because it is replaced on every change, so the lock
+// is taken on a separate file named like the htpasswd file with LockSuffix. It is created next to
+// the htpasswd file, or in the directory given to SetLockDir, and is left in place: removing it
+// while another process holds it would let two writers in at once.
+type Store struct {
+	file    string
+	lockDir string
+	mu      sync.RWMutex
+	// metadata is enabled if metadataFile is set
+	metadataFile string
+	policy       AccountPolicy
+}
+
+// NewStore create a store for a htpasswd file, the file is created on the first write
+func NewStore(file string) *Store {
+	return &Store{file: file}
+}
+
+// NewStoreWithMetadata create a store that keeps metadata of its users in a sidecar file next to
+// the htpasswd file and applies policy when verifying passwords
+func NewStoreWithMetadata(file string, policy AccountPolicy) *Store {
+	return &Store{file: file, metadataFile: file + MetadataSuffix, policy: policy}
+}
+
+// SetLockDir create the lock file in dir instead of next to the htpasswd file, for read-only
+// directories. All processes sharing the file must use the same dir. Call it before the store is
+// used.
+func (s *Store) SetLockDir(dir string) {
+	s.lockDir = dir
+}
+
+// File the htpasswd file of the store
+func (s *Store) File() string {
+	return s.file
+}
+
+// Read load the current passwords
+func (s *Store) Read() (passwords HashedPasswords, err error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	unlock, err := s.lock(false)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	doc, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	return doc.Passwords(), nil
+}
+
+// Update run fn on the current passwords and write the result if fn did not return an error,
+// the order of the users, comments and unknown lines of the file are preserved
+func (s *Store) Update(fn func(passwords HashedPasswords) error) error {
+	return s.UpdateDocument(func(doc *Document) error {
+		passwords := doc.Passwords()
+		err := fn(passwords)
+		if err != nil {
+			return err
+		}
+		doc.Apply(passwords)
+		return nil
+	})
+}
+
+// UpdateDocument run fn on the current document and write the result if fn did not return an error
+func (s *Store) UpdateDocument(fn func(doc *Document) error) error {
+	return s.updateDocument(fn, true)
+}
+
+// updateDocument track tells if changed hashes count as password changes in the metadata
+func (s *Store) updateDocument(fn func(doc *Document) error, track bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	unlock, err := s.lock(true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	doc, err := s.load()
+	if err != nil {
+		return err
+	}
+	before := doc.Passwords()
+	err = fn(doc)
+	if err != nil {
+		return err
+	}
+	err = doc.WriteToFile(s.file)
+	if err != nil || s.metadataFile == "" {
+		return err
+	}
+	metadata, err := ParseMetadataFile(s.metadataFile)
+	if err != nil {
+		return err
+	}
+	after := doc.Passwords()
+	if !track {
+		// keep the timestamps of changed hashes
+		for name := range after {
+			if _, ok := before[name]; ok {
+				before[name] = after[name]
+			}
+		}
+	}
+	metadata.track(before, after, time.Now())
+	return metadata.WriteToFile(s.metadataFile)
+}
+
+// SetPassword set a password for a user with a hashing algo
+func (s *Store) SetPassword(name, password string, hashAlgorithm HashAlgorithm) error {
+	return s.Update(func(passwords HashedPasswords) error {
+		return passwords.SetPassword(name, password, hashAlgorithm)
+	})
+}
+
+// SetPasswordHash directly set a hash for a user
+func (s *Store) SetPasswordHash(name, hash string) error {
+	if len(hash) == 0 {
+		return errors.New("you might want to rethink your hashing algorithm, it left you with an empty hash")
+	}
+	return s.Update(func(passwords HashedPasswords) error {
+		passwords[name] = hash
+		return nil
+	})
+}
+
+// RemoveUser remove an existing user, returns an error if the user does not exist
+func (s *Store) RemoveUser(name string) error {
+	return s.Update(func(passwords HashedPasswords) error {
+		_, ok := passwords[name]
+		if !ok {
+			return ErrUserNotFound
+		}
+		delete(passwords, name)
+		return nil
+	})
+}
+
+// Verify check the password of a user, with metadata the account must also satisfy the policy
+func (s *Store) Verify(name, password string) (bool, error) {
+	if s.metadataFile == "" {
+		passwords, err := s.Read()
+		if err != nil {
+			return false, err
+		}
+		if _, ok := passwords[name]; !ok {
+			verifyUnknownUser(password)
+			return false, nil
+		}
+		return passwords.Verify(name, password), nil
+	}
+	err := s.Authenticate(name, password)
+	switch err {
+	case nil:
+		return true, nil
+	case ErrInvalidCredentials, ErrAccountDisabled, ErrAccountExpired, ErrAccountLocked, ErrAccountInactive, ErrPasswordExpired:
+		return false, nil
+	}
+	return false, err
+}
+
+// Authenticate check the password of a user and, with metadata, the state of the account.
+// Failed attempts and lockouts are recorded in the metadata, logins only if the policy records
+// them. Returns ErrInvalidCredentials for unknown users and wrong passwords, the state of the
+// account is only reported once the password is correct.
+func (s *Store) Authenticate(name, password string) error {
+	if s.metadataFile == "" {
+		ok, err := s.Verify(name, password)
+		if err == nil && !ok {
+			err = ErrInvalidCredentials
+		}
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	unlock, err := s.lock(true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	doc, err := s.load()
+	if err != nil {
+		return err
+	}
+	hash, ok := doc.Get(name)
+	if !ok {
+		verifyUnknownUser(password)
+		return ErrInvalidCredentials
+	}
+	metadata, err := ParseMetadataFile(s.metadataFile)
+	if err != nil {
+		return err
+	}
+	user := metadata.user(name)
+	now := time.Now()
+	changed := false
+	if !user.LockedUntil.IsZero() && !now.Before(user.LockedUntil) {
+		// a timed lockout is over, the attempts that caused it are forgotten
+		user.FailedAttempts = 0
+		user.LockedUntil = time.Time{}
+		changed = true
+	}
+	// the state of the account is only revealed to callers that know the password
+	state := s.policy.check(user, now)
+	if !CheckPassword(password, hash) {
+		if state == nil {
+			s.policy.fail(user, now)
+			changed = true
+		}
+		err = ErrInvalidCredentials
+	} else if state != nil {
+		err = state
+	} else {
+		changed = changed || user.FailedAttempts > 0 || s.policy.recordsLastLogin()
+		user.FailedAttempts = 0
+		if s.policy.recordsLastLogin() {
+			user.LastLogin = now
+		}
+	}
+	if !changed {
+		// nothing to record, logins do not write the file unless they are tracked
+		return err
+	}
+	if writeErr := metadata.WriteToFile(s.metadataFile); writeErr != nil {
+		return writeErr
+	}
+	return err
+}
+
+// Metadata the metadata of all users, empty without metadata
+func (s *Store) Metadata() (Metadata, error) {
+	if s.metadataFile == "" {
+		return Metadata{}, nil
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	unlock, err := s.lock(false)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	return ParseMetadataFile(s.metadataFile)
+}
+
+// UpdateMetadata run fn on the metadata of a user and write the result if fn did not return an error
+func (s *Store) UpdateMetadata(name string, fn func(user *UserMetadata) error) error {
+	if s.metadataFile == "" {
+		return errors.New("metadata is not enabled for " + s.file)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	unlock, err := s.lock(true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	doc, err := s.load()
+	if err != nil {
+		return err
+	}
+	if _, ok := doc.Get(name); !ok {
+		return ErrUserNotFound
+	}
+	metadata, err := ParseMetadataFile(s.metadataFile)
+	if err != nil {
+		return err
+	}
+	err = fn(metadata.user(name))
+	if err != nil {
+		return err
+	}
+	return metadata.WriteToFile(s.metadataFile)
+}
+
+// SetDisabled disable or enable a user
+func (s *Store) SetDisabled(name string, disabled bool) error {
+	return s.UpdateMetadata(name, func(user *UserMetadata) error {
+		user.Disabled = disabled
+		return nil
+	})
+}
+
+// SetExpiry let the account of a user expire at expires, a zero time never expires
+func (s *Store) SetExpiry(name string, expires time.Time) error {
+	return s.UpdateMetadata(name, func(user *UserMetadata) error {
+		user.Expires = expires
+		return nil
+	})
+}
+
+// Unlock a user locked after too many failed attempts
+func (s *Store) Unlock(name string) error {
+	return s.UpdateMetadata(name, func(user *UserMetadata) error {
+		user.Locked = false
+		user.LockedUntil = time.Time{}
+		user.FailedAttempts = 0
+		return nil
+	})
+}
+
+// VerifyAndUpgrade check the password of a user and upgrade a weak hash according to the policy,
+// OnUpgrade of the policy is called after the file was written
+func (s *Store) VerifyAndUpgrade(name, password string, policy RehashPolicy) (ok bool, err error) {
+	ok, err = s.Verify(name, password)
+	if err != nil || !ok {
+		return false, err
+	}
+	passwords, err := s.Read()
+	if err != nil {
+		return false, err
+	}
+	if !policy.NeedsRehash(passwords[name]) {
+		return true, nil
+	}
+	from := IdentifyHash(passwords[name])
+	upgraded := false
+	onUpgrade := policy.OnUpgrade
+	policy.OnUpgrade = nil
+	err = s.updateDocument(func(doc *Document) (err error) {
+		// the file might have changed since it was read
+		passwords := doc.Passwords()
+		ok, upgraded, err = passwords.VerifyAndUpgrade(name, password, policy)
+		doc.Apply(passwords)
+		return err
+	}, false)
+	if err != nil {
+		return ok, err
+	}
+	if upgraded && onUpgrade != nil {
+		onUpgrade(name, from, policy.Algorithm)
+	}
+	return ok, nil
+}
+
+// lock take the lock file, the returned func releases it
+func (s *Store) lock(exclusive bool) (unlock func(), err error) {
+	if s.lockDir != "" {
+		return lockFileAt(filepath.Join(s.lockDir, filepath.Base(s.file)+LockSuffix), exclusive)
+	}
+	return lockPath(s.file, exclusive)
+}
+
+// lockPath take the lock file next to file, shared by everything that replaces file atomically
+func lockPath(file string, exclusive bool) (unlock func(), err error) {
+	return lockFileAt(file+LockSuffix, exclusive)
+}
+
+func lockFileAt(lockFileName string, exclusive bool) (unlock func(), err error) {
+	f, err := os.OpenFile(lockFileName, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	err = lockFile(f, exclusive)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return func() {
+		unlockFile(f)
+		f.Close()
+	}, nil
+}
+
+// load parse the file, a missing file has no users
+func (s *Store) load() (*Document, error) {
+	doc, err := ParseDocumentFile(s.file)
+	if os.IsNotExist(err) {
+		return NewDocument(), nil
+	}
+	return doc, err
+}
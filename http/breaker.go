@@ -0,0 +1,283 @@
+package http
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// CircuitState state of the circuit breaker of a host
+type CircuitState int
+
+const (
+	// CircuitClosed requests pass, failures are counted
+	CircuitClosed CircuitState = iota
+	// CircuitOpen requests fail immediately with a *CircuitOpenError
+	CircuitOpen
+	// CircuitHalfOpen a few probe requests decide whether to close or open again
+	CircuitHalfOpen
+)
+
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitClosed:
+		return "closed"
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+// CircuitOpenError is returned for requests to a host whose circuit is open
+type CircuitOpenError struct {
+	Host string
+	// Until the circuit becomes half-open
+	Until time.Time
+}
+
+func (e *CircuitOpenError) Error() string {
+	return "circuit breaker open for " + e.Host + " until " + e.Until.Format(time.RFC3339)
+}
+
+// BreakerPolicy when the circuit of a host opens and closes again
+type BreakerPolicy struct {
+	// Window the failure rate is computed over the requests of this sliding window
+	Window time.Duration
+	// MinRequests the circuit does not open before this many requests were made in the window
+	MinRequests int
+	// FailureRate the circuit opens when this fraction of the requests in the window failed
+	FailureRate float64
+	// Cooldown how long the circuit stays open before probe requests are let through
+	Cooldown time.Duration
+	// HalfOpenRequests number of successful probes that close the circuit again
+	HalfOpenRequests int
+	// IsFailure tells which results count as failures, network errors and 5xx responses if not set
+	IsFailure func(resp *http.Response, err error) bool
+	// OnStateChange is called whenever the circuit of a host changes its state
+	OnStateChange func(host string, from, to CircuitState)
+}
+
+// DefaultBreakerPolicy opens after half of at least 20 requests in 30 seconds failed
+var DefaultBreakerPolicy = BreakerPolicy{
+	Window:           30 * time.Second,
+	MinRequests:      20,
+	FailureRate:      0.5,
+	Cooldown:         10 * time.Second,
+	HalfOpenRequests: 3,
+}
+
+// WithCircuitBreaker give every upstream host of the client its own circuit breaker
+func WithCircuitBreaker(policy BreakerPolicy) ClientOption {
+	return func(c *Client) {
+		c.breakers = &circuitBreakers{policy: policy, hosts: map[string]*circuitBreaker{}}
+	}
+}
+
+// CircuitState the state of the circuit breaker of a host, always closed without a breaker
+func (c *Client) CircuitState(host string) CircuitState {
+	if c.breakers == nil {
+		return CircuitClosed
+	}
+	return c.breakers.get(host).state(time.Now())
+}
+
+// breakerBuckets the sliding window is made of this many buckets
+const breakerBuckets = 10
+
+type circuitBreakers struct {
+	policy BreakerPolicy
+	mu     sync.Mutex
+	hosts  map[string]*circuitBreaker
+}
+
+func (b *circuitBreakers) get(host string) *circuitBreaker {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	breaker, ok := b.hosts[host]
+	if !ok {
+		breaker = &circuitBreaker{host: host, policy: &b.policy}
+		b.hosts[host] = breaker
+	}
+	return breaker
+}
+
+type breakerBucket struct {
+	start              time.Time
+	requests, failures int
+}
+
+type circuitBreaker struct {
+	host      string
+	policy    *BreakerPolicy
+	mu        sync.Mutex
+	current   CircuitState
+	openedAt  time.Time
+	buckets   [breakerBuckets]breakerBucket
+	probes    int
+	successes int
+}
+
+// state the state at now, an open circuit becomes half-open after the cooldown
+func (b *circuitBreaker) state(now time.Time) CircuitState {
+	b.mu.Lock()
+	notify := b.advance(now)
+	state := b.current
+	b.mu.Unlock()
+	notify()
+	return state
+}
+
+// advance move from open to half-open after the cooldown, the returned func reports the change
+// and must be called without holding the lock
+func (b *circuitBreaker) advance(now time.Time) func() {
+	if b.current == CircuitOpen && !now.Before(b.openedAt.Add(b.policy.Cooldown)) {
+		return b.set(CircuitHalfOpen, now)
+	}
+	return func() {}
+}
+
+func (b *circuitBreaker) set(state CircuitState, now time.Time) func() {
+	from := b.current
+	b.current = state
+	b.probes, b.successes = 0, 0
+	switch state {
+	case CircuitOpen:
+		b.openedAt = now
+	case CircuitClosed:
+		b.buckets = [breakerBuckets]breakerBucket{}
+	}
+	onStateChange := b.policy.OnStateChange
+	if onStateChange == nil || from == state {
+		return func() {}
+	}
+	return func() { onStateChange(b.host, from, state) }
+}
+
+// allow reserve a request, returns a *CircuitOpenError if the circuit is open
+func (b *circuitBreaker) allow(now time.Time) error {
+	b.mu.Lock()
+	notify := b.advance(now)
+	var err error
+	switch b.current {
+	case CircuitOpen:
+		err = &CircuitOpenError{Host: b.host, Until: b.openedAt.Add(b.policy.Cooldown)}
+	case CircuitHalfOpen:
+		if b.probes >= b.halfOpenRequests() {
+			err = &CircuitOpenError{Host: b.host, Until: now}
+		} else {
+			b.probes++
+		}
+	}
+	b.mu.Unlock()
+	notify()
+	return err
+}
+
+func (b *circuitBreaker) halfOpenRequests() int {
+	if b.policy.HalfOpenRequests < 1 {
+		return 1
+	}
+	return b.policy.HalfOpenRequests
+}
+
+// record the result of a request that was allowed
+func (b *circuitBreaker) record(now time.Time, failed bool) {
+	b.mu.Lock()
+	notify := func() {}
+	switch b.current {
+	case CircuitHalfOpen:
+		if failed {
+			notify = b.set(CircuitOpen, now)
+		} else if b.successes++; b.successes >= b.halfOpenRequests() {
+			notify = b.set(CircuitClosed, now)
+		}
+	case CircuitClosed:
+		bucket := b.bucket(now)
+		bucket.requests++
+		if failed {
+			bucket.failures++
+		}
+		requests, failures := b.window(now)
+		if requests >= b.policy.MinRequests && requests > 0 && float64(failures)/float64(requests) >= b.policy.FailureRate {
+			notify = b.set(CircuitOpen, now)
+		}
+	}
+	b.mu.Unlock()
+	notify()
+}
+
+// release a request that was allowed but has no result
+func (b *circuitBreaker) release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.current == CircuitHalfOpen && b.probes > 0 {
+		b.probes--
+	}
+}
+
+func (b *circuitBreaker) bucketSize() time.Duration {
+	size := b.policy.Window / breakerBuckets
+	if size <= 0 {
+		size = time.Second
+	}
+	return size
+}
+
+// bucket the bucket of now, reset if it belonged to an earlier round of the ring
+func (b *circuitBreaker) bucket(now time.Time) *breakerBucket {
+	size := b.bucketSize()
+	start := now.Truncate(size)
+	bucket := &b.buckets[(start.UnixNano()/int64(size))%breakerBuckets]
+	if !bucket.start.Equal(start) {
+		*bucket = breakerBucket{start: start}
+	}
+	return bucket
+}
+
+// window requests and failures in the sliding window ending at now
+func (b *circuitBreaker) window(now time.Time) (requests, failures int) {
+	oldest := now.Add(-b.bucketSize() * breakerBuckets)
+	for _, bucket := range b.buckets {
+		if bucket.start.After(oldest) {
+			requests += bucket.requests
+			failures += bucket.failures
+		}
+	}
+	return
+}
+
+// breakerTransport guards the hosts of next with circuit breakers
+type breakerTransport struct {
+	next     http.RoundTripper
+	breakers *circuitBreakers
+}
+
+func (t *breakerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	breaker := t.breakers.get(req.URL.Host)
+	if err := breaker.allow(time.Now()); err != nil {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, err
+	}
+	resp, err := t.next.RoundTrip(req)
+	if errors.Is(req.Context().Err(), context.Canceled) {
+		// cancelled by the caller, this says nothing about the host, timeouts do
+		breaker.release()
+		return resp, err
+	}
+	isFailure := t.breakers.policy.IsFailure
+	if isFailure == nil {
+		isFailure = defaultIsFailure
+	}
+	breaker.record(time.Now(), isFailure(resp, err))
+	return resp, err
+}
+
+func defaultIsFailure(resp *http.Response, err error) bool {
+	return err != nil || resp.StatusCode >= 500
+}
@@ -0,0 +1,504 @@
+package http
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CacheHeader tells how a response came from the cache, one of the CacheHit... values
+const CacheHeader = "X-Cache"
+
+// values of CacheHeader
+const (
+	CacheHit         = "HIT"
+	CacheMiss        = "MISS"
+	CacheRevalidated = "REVALIDATED"
+	CacheStale       = "STALE"
+)
+
+// maxCachedBody responses with larger bodies are not cached
+const maxCachedBody = 10 << 20
+
+// CachedResponse a stored response
+type CachedResponse struct {
+	Status int         `json:"status"`
+	Header http.Header `json:"header"`
+	Body   []byte      `json:"body"`
+	// Vary the values of the request headers named by the Vary header
+	Vary         map[string]string `json:"vary,omitempty"`
+	RequestTime  time.Time         `json:"requestTime"`
+	ResponseTime time.Time         `json:"responseTime"`
+}
+
+// CacheStorage stores responses by key, implementations must be safe for concurrent use
+type CacheStorage interface {
+	Get(key string) (*CachedResponse, bool)
+	Set(key string, resp *CachedResponse)
+	Delete(key string)
+}
+
+// WithCache cache responses to GET requests in storage as a private cache following RFC 9111.
+// Responses to requests with an Authorization header are only cached if they are marked public,
+// s-maxage or must-revalidate, since the client may be shared by several users.
+func WithCache(storage CacheStorage) ClientOption {
+	return func(c *Client) {
+		c.cache = &cacheTransport{storage: storage, revalidating: map[string]bool{}}
+	}
+}
+
+// MemoryCache a CacheStorage that keeps the most recently used responses in memory
+type MemoryCache struct {
+	maxEntries int
+	mu         sync.Mutex
+	lru        *list.List
+	entries    map[string]*list.Element
+}
+
+type memoryEntry struct {
+	key  string
+	resp *CachedResponse
+}
+
+// NewMemoryCache a cache of at most maxEntries responses, 0 means no limit
+func NewMemoryCache(maxEntries int) *MemoryCache {
+	return &MemoryCache{maxEntries: maxEntries, lru: list.New(), entries: map[string]*list.Element{}}
+}
+
+// Get implements CacheStorage
+func (m *MemoryCache) Get(key string) (*CachedResponse, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e, ok := m.entries[key]
+	if !ok {
+		return nil, false
+	}
+	m.lru.MoveToFront(e)
+	return e.Value.(*memoryEntry).resp, true
+}
+
+// Set implements CacheStorage
+func (m *MemoryCache) Set(key string, resp *CachedResponse) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if e, ok := m.entries[key]; ok {
+		e.Value.(*memoryEntry).resp = resp
+		m.lru.MoveToFront(e)
+		return
+	}
+	m.entries[key] = m.lru.PushFront(&memoryEntry{key: key, resp: resp})
+	if m.maxEntries > 0 && m.lru.Len() > m.maxEntries {
+		oldest := m.lru.Back()
+		m.lru.Remove(oldest)
+		delete(m.entries, oldest.Value.(*memoryEntry).key)
+	}
+}
+
+// Delete implements CacheStorage
+func (m *MemoryCache) Delete(key string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if e, ok := m.entries[key]; ok {
+		m.lru.Remove(e)
+		delete(m.entries, key)
+	}
+}
+
+// Len the number of cached responses
+func (m *MemoryCache) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.lru.Len()
+}
+
+// DiskCache a CacheStorage with a JSON file per response in a directory
+type DiskCache struct {
+	dir string
+	mu  sync.Mutex
+}
+
+// NewDiskCache a cache in dir, the directory is created if missing
+func NewDiskCache(dir string) (*DiskCache, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &DiskCache{dir: dir}, nil
+}
+
+func (d *DiskCache) file(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(d.dir, hex.EncodeToString(sum[:])+".json")
+}
+
+// Get implements CacheStorage
+func (d *DiskCache) Get(key string) (*CachedResponse, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	data, err := ioutil.ReadFile(d.file(key))
+	if err != nil {
+		return nil, false
+	}
+	resp := &CachedResponse{}
+	if json.Unmarshal(data, resp) != nil {
+		return nil, false
+	}
+	return resp, true
+}
+
+// Set implements CacheStorage
+func (d *DiskCache) Set(key string, resp *CachedResponse) {
+	data, err := json.Marshal(resp)
+	if err != nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	file := d.file(key)
+	tmp := file + ".tmp"
+	if ioutil.WriteFile(tmp, data, 0600) == nil {
+		os.Rename(tmp, file)
+	}
+}
+
+// Delete implements CacheStorage
+func (d *DiskCache) Delete(key string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	os.Remove(d.file(key))
+}
+
+// cacheControl the directives of a Cache-Control header, directives without value map to ""
+type cacheControl map[string]string
+
+func parseCacheControl(header http.Header) cacheControl {
+	cc := cacheControl{}
+	for _, value := range header.Values("Cache-Control") {
+		for _, directive := range strings.Split(value, ",") {
+			directive = strings.TrimSpace(directive)
+			if directive == "" {
+				continue
+			}
+			name, arg := directive, ""
+			if i := strings.IndexByte(directive, '='); i >= 0 {
+				name, arg = directive[:i], strings.Trim(directive[i+1:], `"`)
+			}
+			cc[strings.ToLower(name)] = arg
+		}
+	}
+	return cc
+}
+
+func (cc cacheControl) has(name string) bool {
+	_, ok := cc[name]
+	return ok
+}
+
+// seconds the value of a delta-seconds directive
+func (cc cacheControl) seconds(name string) (time.Duration, bool) {
+	value, ok := cc[name]
+	if !ok {
+		return 0, false
+	}
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || seconds < 0 {
+		return 0, false
+	}
+	return time.Duration(seconds) * time.Second, true
+}
+
+// cacheableStatus status codes that are cacheable by default, RFC 9110 15.1
+func cacheableStatus(status int) bool {
+	switch status {
+	case 200, 203, 204, 300, 301, 308, 404, 405, 410, 414, 501:
+		return true
+	}
+	return false
+}
+
+// freshness the freshness lifetime of a stored response, RFC 9111 4.2.1
+func (r *CachedResponse) freshness() time.Duration {
+	cc := parseCacheControl(r.Header)
+	if maxAge, ok := cc.seconds("max-age"); ok {
+		return maxAge
+	}
+	date, err := http.ParseTime(r.Header.Get("Date"))
+	if err != nil {
+		date = r.ResponseTime
+	}
+	if value := r.Header.Get("Expires"); value != "" {
+		expires, err := http.ParseTime(value)
+		if err != nil {
+			return 0
+		}
+		return expires.Sub(date)
+	}
+	if lastModified, err := http.ParseTime(r.Header.Get("Last-Modified")); err == nil && date.After(lastModified) {
+		// heuristic freshness, RFC 9111 4.2.2
+		return date.Sub(lastModified) / 10
+	}
+	return 0
+}
+
+// age the current age of a stored response, RFC 9111 4.2.3
+func (r *CachedResponse) age(now time.Time) time.Duration {
+	var apparent time.Duration
+	if date, err := http.ParseTime(r.Header.Get("Date")); err == nil && r.ResponseTime.After(date) {
+		apparent = r.ResponseTime.Sub(date)
+	}
+	ageValue, _ := strconv.ParseInt(r.Header.Get("Age"), 10, 64)
+	corrected := time.Duration(ageValue)*time.Second + r.ResponseTime.Sub(r.RequestTime)
+	if apparent > corrected {
+		corrected = apparent
+	}
+	return corrected + now.Sub(r.ResponseTime)
+}
+
+// varies tell if the stored response was for a request with other values of the Vary headers
+func (r *CachedResponse) varies(req *http.Request) bool {
+	for name, value := range r.Vary {
+		if req.Header.Get(name) != value {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *CachedResponse) response(req *http.Request, status string) *http.Response {
+	header := r.Header.Clone()
+	header.Set(CacheHeader, status)
+	header.Set("Age", strconv.FormatInt(int64(r.age(time.Now())/time.Second), 10))
+	return &http.Response{
+		Status:        strconv.Itoa(r.Status) + " " + http.StatusText(r.Status),
+		StatusCode:    r.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          ioutil.NopCloser(bytes.NewReader(r.Body)),
+		ContentLength: int64(len(r.Body)),
+		Request:       req,
+	}
+}
+
+// cacheTransport answers GET requests from storage and stores the responses of next
+type cacheTransport struct {
+	next         http.RoundTripper
+	storage      CacheStorage
+	mu           sync.Mutex
+	revalidating map[string]bool
+}
+
+func cacheKey(req *http.Request) string {
+	return req.Method + " " + req.URL.String()
+}
+
+// notModifiedSkips headers of a 304 response that describe its own empty body rather than the
+// stored one and must not replace the stored headers, RFC 9111 section 3.2
+var notModifiedSkips = map[string]bool{
+	"Content-Length":    true,
+	"Content-Encoding":  true,
+	"Transfer-Encoding": true,
+	"Content-Range":     true,
+}
+
+func (t *cacheTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		resp, err := t.next.RoundTrip(req)
+		if err == nil && resp.StatusCode < 400 && !safeMethod(req.Method) {
+			// unsafe requests invalidate the stored responses of their url, RFC 9111 4.4
+			t.storage.Delete(http.MethodGet + " " + req.URL.String())
+			t.storage.Delete(http.MethodHead + " " + req.URL.String())
+		}
+		return resp, err
+	}
+	reqCC := parseCacheControl(req.Header)
+	if reqCC.has("no-store") || req.Header.Get("Range") != "" {
+		return t.next.RoundTrip(req)
+	}
+	key := cacheKey(req)
+	cached, ok := t.storage.Get(key)
+	if ok && (cached.varies(req) || !sharedWith(req, cached.Header)) {
+		ok = false
+	}
+	if !ok {
+		if reqCC.has("only-if-cached") {
+			return &http.Response{StatusCode: http.StatusGatewayTimeout, Status: "504 Gateway Timeout", Header: http.Header{},
+				Body: http.NoBody, Request: req}, nil
+		}
+		return t.fetch(req, key, nil)
+	}
+	now := time.Now()
+	respCC := parseCacheControl(cached.Header)
+	age, lifetime := cached.age(now), cached.freshness()
+	if maxAge, ok := reqCC.seconds("max-age"); ok && maxAge < lifetime {
+		lifetime = maxAge
+	}
+	mustRevalidate := reqCC.has("no-cache") || respCC.has("no-cache")
+	if !mustRevalidate && age < lifetime {
+		return cached.response(req, CacheHit), nil
+	}
+	if swr, ok := respCC.seconds("stale-while-revalidate"); ok && !mustRevalidate && !respCC.has("must-revalidate") && age < lifetime+swr {
+		t.revalidateInBackground(req, key, cached)
+		return cached.response(req, CacheStale), nil
+	}
+	return t.fetch(req, key, cached)
+}
+
+// fetch send req, revalidating cached if there is one, and store the response if allowed
+func (t *cacheTransport) fetch(req *http.Request, key string, cached *CachedResponse) (*http.Response, error) {
+	if cached != nil {
+		req = req.Clone(req.Context())
+		if etag := cached.Header.Get("ETag"); etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+		if lastModified := cached.Header.Get("Last-Modified"); lastModified != "" {
+			req.Header.Set("If-Modified-Since", lastModified)
+		}
+	}
+	requestTime := time.Now()
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	responseTime := time.Now()
+	if cached != nil && resp.StatusCode == http.StatusNotModified {
+		resp.Body.Close()
+		updated := *cached
+		updated.Header = cached.Header.Clone()
+		for k, v := range resp.Header {
+			if !notModifiedSkips[k] {
+				updated.Header[k] = v
+			}
+		}
+		updated.RequestTime, updated.ResponseTime = requestTime, responseTime
+		t.storage.Set(key, &updated)
+		return updated.response(req, CacheRevalidated), nil
+	}
+	if !t.storable(req, resp) {
+		resp.Header.Set(CacheHeader, CacheMiss)
+		return resp, nil
+	}
+	body, complete, err := readLimited(resp.Body, maxCachedBody)
+	if err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	if !complete {
+		resp.Body = &readCloser{Reader: io.MultiReader(bytes.NewReader(body), resp.Body), Closer: resp.Body}
+		resp.Header.Set(CacheHeader, CacheMiss)
+		return resp, nil
+	}
+	resp.Body.Close()
+	stored := &CachedResponse{
+		Status:       resp.StatusCode,
+		Header:       resp.Header.Clone(),
+		Body:         body,
+		RequestTime:  requestTime,
+		ResponseTime: responseTime,
+	}
+	for _, name := range varyHeaders(resp.Header) {
+		if stored.Vary == nil {
+			stored.Vary = map[string]string{}
+		}
+		stored.Vary[name] = req.Header.Get(name)
+	}
+	t.storage.Set(key, stored)
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	resp.Header.Set(CacheHeader, CacheMiss)
+	return resp, nil
+}
+
+// storable tell if a response may be stored, RFC 9111 3
+func (t *cacheTransport) storable(req *http.Request, resp *http.Response) bool {
+	cc := parseCacheControl(resp.Header)
+	if cc.has("no-store") || parseCacheControl(req.Header).has("no-store") || !cacheableStatus(resp.StatusCode) {
+		return false
+	}
+	for _, name := range varyHeaders(resp.Header) {
+		if name == "*" {
+			return false
+		}
+	}
+	if !sharedWith(req, resp.Header) {
+		return false
+	}
+	return cc.has("max-age") || cc.has("no-cache") || resp.Header.Get("Expires") != "" ||
+		resp.Header.Get("ETag") != "" || resp.Header.Get("Last-Modified") != ""
+}
+
+// sharedWith tell if a response may be stored for or served to req. A client is shared by all
+// its callers, so responses to requests with credentials are only reused if they allow it,
+// RFC 9111 section 3.5.
+func sharedWith(req *http.Request, header http.Header) bool {
+	if req.Header.Get("Authorization") == "" {
+		return true
+	}
+	cc := parseCacheControl(header)
+	return cc.has("public") || cc.has("s-maxage") || cc.has("must-revalidate")
+}
+
+func varyHeaders(header http.Header) []string {
+	var names []string
+	for _, value := range header.Values("Vary") {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+	return names
+}
+
+// revalidateInBackground refresh a stale response once, while it is served
+func (t *cacheTransport) revalidateInBackground(req *http.Request, key string, cached *CachedResponse) {
+	t.mu.Lock()
+	if t.revalidating[key] {
+		t.mu.Unlock()
+		return
+	}
+	t.revalidating[key] = true
+	t.mu.Unlock()
+	req = req.Clone(context.WithoutCancel(req.Context()))
+	go func() {
+		defer func() {
+			t.mu.Lock()
+			delete(t.revalidating, key)
+			t.mu.Unlock()
+		}()
+		ctx, cancel := context.WithTimeout(req.Context(), time.Duration(HTTP_TIMEOUT)*time.Second)
+		defer cancel()
+		if resp, err := t.fetch(req.WithContext(ctx), key, cached); err == nil {
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+		}
+	}()
+}
+
+// readLimited read up to limit bytes, complete is false if there is more
+func readLimited(r io.Reader, limit int64) (data []byte, complete bool, err error) {
+	data, err = ioutil.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, false, err
+	}
+	if int64(len(data)) > limit {
+		return data, false, nil
+	}
+	return data, true, nil
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
@@ -0,0 +1,368 @@
+package http
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"unicode/utf8"
+)
+
+// RecorderMode whether a Recorder sends requests or answers them from its cassette
+type RecorderMode int
+
+const (
+	// ModeReplay answer requests from the cassette, requests without an interaction fail
+	ModeReplay RecorderMode = iota
+	// ModeRecord send all requests and record them, the cassette starts empty
+	ModeRecord
+	// ModeReplayOrRecord replay recorded interactions and record the others
+	ModeReplayOrRecord
+)
+
+// RecordedRequest a request of a cassette
+type RecordedRequest struct {
+	Method string      `json:"method"`
+	URL    string      `json:"url"`
+	Header http.Header `json:"header,omitempty"`
+	Body   Body        `json:"body"`
+}
+
+// RecordedResponse a response of a cassette
+type RecordedResponse struct {
+	Status int         `json:"status"`
+	Header http.Header `json:"header,omitempty"`
+	Body   Body        `json:"body"`
+}
+
+// Interaction a request and its response
+type Interaction struct {
+	Request  RecordedRequest  `json:"request"`
+	Response RecordedResponse `json:"response"`
+}
+
+// Body a recorded body, stored as text if it is UTF-8 and as base64 otherwise
+type Body []byte
+
+type jsonBody struct {
+	Text   string `json:"text,omitempty"`
+	Base64 string `json:"base64,omitempty"`
+}
+
+// MarshalJSON implements json.Marshaler
+func (b Body) MarshalJSON() ([]byte, error) {
+	if utf8.Valid(b) {
+		return json.Marshal(jsonBody{Text: string(b)})
+	}
+	return json.Marshal(jsonBody{Base64: base64.StdEncoding.EncodeToString(b)})
+}
+
+// UnmarshalJSON implements json.Unmarshaler
+func (b *Body) UnmarshalJSON(data []byte) error {
+	var body jsonBody
+	if err := json.Unmarshal(data, &body); err != nil {
+		return err
+	}
+	if body.Base64 == "" {
+		*b = Body(body.Text)
+		return nil
+	}
+	decoded, err := base64.StdEncoding.DecodeString(body.Base64)
+	*b = decoded
+	return err
+}
+
+// Matcher tells if a live request matches a recorded one, both were redacted the same way
+type Matcher func(live, recorded *RecordedRequest) bool
+
+// MatchMethodURL the default Matcher
+func MatchMethodURL(live, recorded *RecordedRequest) bool {
+	return live.Method == recorded.Method && live.URL == recorded.URL
+}
+
+// MatchBody requests match if their bodies are equal
+func MatchBody(live, recorded *RecordedRequest) bool {
+	return bytes.Equal(live.Body, recorded.Body)
+}
+
+// MatchHeaders requests match if they have the same values of the given headers
+func MatchHeaders(keys ...string) Matcher {
+	return func(live, recorded *RecordedRequest) bool {
+		for _, key := range keys {
+			a, b := live.Header.Values(key), recorded.Header.Values(key)
+			if len(a) != len(b) {
+				return false
+			}
+			for i := range a {
+				if a[i] != b[i] {
+					return false
+				}
+			}
+		}
+		return true
+	}
+}
+
+// MatchAll requests match if all matchers match
+func MatchAll(matchers ...Matcher) Matcher {
+	return func(live, recorded *RecordedRequest) bool {
+		for _, match := range matchers {
+			if !match(live, recorded) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// Redactor removes secrets from an interaction before it is saved or matched
+type Redactor func(i *Interaction)
+
+// Redacted replaces secrets
+const Redacted = "REDACTED"
+
+// RedactHeaders replace the values of request and response headers
+func RedactHeaders(keys ...string) Redactor {
+	return func(i *Interaction) {
+		for _, key := range keys {
+			for _, header := range []http.Header{i.Request.Header, i.Response.Header} {
+				if values := header.Values(key); len(values) > 0 {
+					redacted := make([]string, len(values))
+					for j := range redacted {
+						redacted[j] = Redacted
+					}
+					header[http.CanonicalHeaderKey(key)] = redacted
+				}
+			}
+		}
+	}
+}
+
+// RedactQuery replace the values of query parameters of the request url
+func RedactQuery(params ...string) Redactor {
+	return func(i *Interaction) {
+		u, err := url.Parse(i.Request.URL)
+		if err != nil {
+			return
+		}
+		query := u.Query()
+		changed := false
+		for _, param := range params {
+			if values, ok := query[param]; ok {
+				for j := range values {
+					values[j] = Redacted
+				}
+				changed = true
+			}
+		}
+		if changed {
+			u.RawQuery = query.Encode()
+			i.Request.URL = u.String()
+		}
+	}
+}
+
+// RedactBody replace matches of pattern in request and response bodies, the replacement may use
+// $1 like regexp.ReplaceAll
+func RedactBody(pattern *regexp.Regexp, replacement string) Redactor {
+	return func(i *Interaction) {
+		i.Request.Body = pattern.ReplaceAll(i.Request.Body, []byte(replacement))
+		i.Response.Body = pattern.ReplaceAll(i.Response.Body, []byte(replacement))
+	}
+}
+
+// RecorderOptions how a Recorder records and replays
+type RecorderOptions struct {
+	Mode RecorderMode
+	// Match MatchMethodURL if not set
+	Match  Matcher
+	Redact []Redactor
+}
+
+// NoInteractionError a request in ModeReplay that the cassette has no interaction for
+type NoInteractionError struct {
+	Method, URL string
+}
+
+func (e *NoInteractionError) Error() string {
+	return "no recorded interaction for " + e.Method + " " + e.URL
+}
+
+// Recorder records interactions to a cassette file and replays them
+type Recorder struct {
+	file    string
+	options RecorderOptions
+	mu      sync.Mutex
+	// Interactions of the cassette, in the order they were recorded
+	interactions []*Interaction
+	used         []bool
+}
+
+// NewRecorder load the cassette file, it may be missing unless the mode is ModeReplay
+func NewRecorder(file string, options RecorderOptions) (*Recorder, error) {
+	r := &Recorder{file: file, options: options}
+	if r.options.Match == nil {
+		r.options.Match = MatchMethodURL
+	}
+	if options.Mode == ModeRecord {
+		return r, nil
+	}
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) && options.Mode == ModeReplayOrRecord {
+		return r, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(data, &r.interactions); err != nil {
+		return nil, err
+	}
+	r.used = make([]bool, len(r.interactions))
+	return r, nil
+}
+
+// WithRecorder record or replay the requests of the client, in place of its transport
+func WithRecorder(recorder *Recorder) ClientOption {
+	return func(c *Client) {
+		c.recorder = recorder
+	}
+}
+
+// Interactions the interactions of the cassette
+func (r *Recorder) Interactions() []*Interaction {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]*Interaction(nil), r.interactions...)
+}
+
+// Save write the cassette file
+func (r *Recorder) Save() error {
+	r.mu.Lock()
+	data, err := json.MarshalIndent(r.interactions, "", "  ")
+	r.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	// a temporary file renamed over the cassette, so that a failed save keeps the old cassette
+	tmp, err := ioutil.TempFile(filepath.Dir(r.file), filepath.Base(r.file)+".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(append(data, '\n'))
+	if err == nil {
+		err = tmp.Chmod(0644)
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), r.file)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// transport a RoundTripper that uses next for requests that are recorded
+func (r *Recorder) transport(next http.RoundTripper) http.RoundTripper {
+	return RoundTripFunc(func(req *http.Request) (*http.Response, error) {
+		return r.roundTrip(next, req)
+	})
+}
+
+func (r *Recorder) roundTrip(next http.RoundTripper, req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil && req.Body != http.NoBody {
+		var err error
+		body, err = ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		req = req.Clone(req.Context())
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	live := &Interaction{Request: RecordedRequest{Method: req.Method, URL: req.URL.String(), Header: req.Header.Clone(), Body: body}}
+	r.redact(live)
+	if r.options.Mode != ModeRecord {
+		if recorded := r.find(&live.Request); recorded != nil {
+			return recorded.response(req), nil
+		}
+		if r.options.Mode == ModeReplay {
+			return nil, &NoInteractionError{Method: req.Method, URL: live.Request.URL}
+		}
+	}
+	resp, err := next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(data))
+	recorded := &Interaction{
+		Request:  RecordedRequest{Method: req.Method, URL: req.URL.String(), Header: req.Header.Clone(), Body: body},
+		Response: RecordedResponse{Status: resp.StatusCode, Header: resp.Header.Clone(), Body: data},
+	}
+	r.redact(recorded)
+	r.mu.Lock()
+	r.interactions = append(r.interactions, recorded)
+	r.used = append(r.used, true)
+	r.mu.Unlock()
+	return resp, nil
+}
+
+func (r *Recorder) redact(i *Interaction) {
+	if i.Request.Header == nil {
+		i.Request.Header = http.Header{}
+	}
+	if i.Response.Header == nil {
+		i.Response.Header = http.Header{}
+	}
+	for _, redact := range r.options.Redact {
+		redact(i)
+	}
+}
+
+// find the first unused matching interaction, matches are replayed in order and the last one is
+// repeated once all were used
+func (r *Recorder) find(live *RecordedRequest) *Interaction {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var last *Interaction
+	for i, interaction := range r.interactions {
+		if !r.options.Match(live, &interaction.Request) {
+			continue
+		}
+		if !r.used[i] {
+			r.used[i] = true
+			return interaction
+		}
+		last = interaction
+	}
+	return last
+}
+
+func (i *Interaction) response(req *http.Request) *http.Response {
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", i.Response.Status, http.StatusText(i.Response.Status)),
+		StatusCode:    i.Response.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        i.Response.Header.Clone(),
+		Body:          ioutil.NopCloser(bytes.NewReader(i.Response.Body)),
+		ContentLength: int64(len(i.Response.Body)),
+		Request:       req,
+	}
+}
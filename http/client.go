@@ -0,0 +1,337 @@
+package http
+
+import (
+	"context"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Client a reusable http client, its Transport pools connections so create it once and share it.
+// Requests take a context for cancellation and Options for everything specific to a request.
+type Client struct {
+	client    *http.Client
+	transport *http.Transport
+	options   []Option
+	retry     *RetryPolicy
+	breakers  *circuitBreakers
+	noProxy   []string
+	limiter   *limiter
+	recorder  *Recorder
+	cache     *cacheTransport
+	// compression nil leaves it to net/http, which only handles gzip responses
+	compression *CompressionPolicy
+	// interceptors outermost first
+	interceptors []Interceptor
+	// err of a ClientOption, returned by every request
+	err error
+}
+
+// ClientOption configures a Client in NewClient
+type ClientOption func(c *Client)
+
+// Option configures a single request
+type Option func(r *request)
+
+// request everything the Options of a request collect
+type request struct {
+	timeout time.Duration
+	header  http.Header
+	query   url.Values
+}
+
+// DefaultClient used by HttpRequest and the other package level functions
+var DefaultClient = NewClient(WithRetry(DefaultRetryPolicy))
+
+// NewClient create a client with a pooled transport
+func NewClient(options ...ClientOption) *Client {
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   10 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   10,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+	c := &Client{
+		client:    &http.Client{Transport: transport},
+		transport: transport,
+	}
+	for _, option := range options {
+		option(c)
+	}
+	c.transport.Proxy = bypass(c.transport.Proxy, c.noProxy)
+	c.client.Transport = c.roundTripper()
+	return c
+}
+
+// roundTripper wrap the transport in the layers configured by the ClientOptions
+func (c *Client) roundTripper() http.RoundTripper {
+	var rt http.RoundTripper = c.transport
+	if c.recorder != nil {
+		rt = c.recorder.transport(rt)
+	}
+	if c.compression != nil {
+		rt = &compressTransport{next: rt, policy: *c.compression}
+	}
+	if c.limiter != nil {
+		rt = &limitTransport{next: rt, limiter: c.limiter}
+	}
+	if c.breakers != nil {
+		rt = &breakerTransport{next: rt, breakers: c.breakers}
+	}
+	if c.retry != nil {
+		rt = &retryTransport{next: rt, policy: *c.retry}
+	}
+	if c.cache != nil {
+		c.cache.next = rt
+		rt = c.cache
+	}
+	for i := len(c.interceptors) - 1; i >= 0; i-- {
+		rt = c.interceptors[i](rt)
+	}
+	return rt
+}
+
+// WithDefaultOptions apply options to every request of the client, before the options of the request
+func WithDefaultOptions(options ...Option) ClientOption {
+	return func(c *Client) {
+		c.options = append(c.options, options...)
+	}
+}
+
+// WithDialTimeout limit the time to establish a connection
+func WithDialTimeout(timeout time.Duration) ClientOption {
+	return func(c *Client) {
+		c.transport.DialContext = (&net.Dialer{
+			Timeout:   timeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext
+	}
+}
+
+// WithMaxIdleConnsPerHost number of idle connections kept per host
+func WithMaxIdleConnsPerHost(n int) ClientOption {
+	return func(c *Client) {
+		c.transport.MaxIdleConnsPerHost = n
+	}
+}
+
+// Err the first error of the ClientOptions, requests of the client fail with it
+func (c *Client) Err() error {
+	return c.err
+}
+
+func (c *Client) fail(err error) {
+	if c.err == nil {
+		c.err = err
+	}
+}
+
+// HTTPClient the underlying net/http client
+func (c *Client) HTTPClient() *http.Client {
+	return c.client
+}
+
+// Transport the pooled transport of the client
+func (c *Client) Transport() *http.Transport {
+	return c.transport
+}
+
+// CloseIdleConnections close the idle connections of the pool
+func (c *Client) CloseIdleConnections() {
+	c.transport.CloseIdleConnections()
+}
+
+// WithTimeout limit the whole request including reading the body, 0 means no limit
+func WithTimeout(timeout time.Duration) Option {
+	return func(r *request) {
+		r.timeout = timeout
+	}
+}
+
+// WithHeader set a request header
+func WithHeader(key, value string) Option {
+	return func(r *request) {
+		r.header.Set(key, value)
+	}
+}
+
+// WithHeaders set request headers from a map, nil is allowed
+func WithHeaders(header *map[string]string) Option {
+	return WithHeaderValues(headerFromMap(header))
+}
+
+// WithAddedHeader add a value to a request header, keeping the values it already has
+func WithAddedHeader(key, value string) Option {
+	return func(r *request) {
+		r.header.Add(key, value)
+	}
+}
+
+// WithHeaderValues set request headers with all their values
+func WithHeaderValues(header http.Header) Option {
+	return func(r *request) {
+		for k, v := range header {
+			r.header[http.CanonicalHeaderKey(k)] = append([]string(nil), v...)
+		}
+	}
+}
+
+// WithQuery add a query parameter to the url
+func WithQuery(key, value string) Option {
+	return func(r *request) {
+		r.query.Add(key, value)
+	}
+}
+
+// WithParams add query parameters from a map, nil is allowed
+func WithParams(params *map[string]string) Option {
+	return WithQueryValues(valuesFromMap(params))
+}
+
+// WithQueryValues add query parameters with all their values
+func WithQueryValues(query url.Values) Option {
+	return func(r *request) {
+		for k, v := range query {
+			r.query[k] = append(r.query[k], v...)
+		}
+	}
+}
+
+// WithBasicAuth authenticate with HTTP basic authentication
+func WithBasicAuth(user, password string) Option {
+	return func(r *request) {
+		r.header.Set("Authorization", "Basic "+basicAuth(user, password))
+	}
+}
+
+// WithBearerToken authenticate with an OAuth 2 bearer token
+func WithBearerToken(token string) Option {
+	return func(r *request) {
+		r.header.Set("Authorization", "Bearer "+token)
+	}
+}
+
+// WithUserAgent set the User-Agent header
+func WithUserAgent(userAgent string) Option {
+	return func(r *request) {
+		r.header.Set("User-Agent", userAgent)
+	}
+}
+
+func basicAuth(user, password string) string {
+	return base64.StdEncoding.EncodeToString([]byte(user + ":" + password))
+}
+
+// Do send a request and read the whole response
+func (c *Client) Do(ctx context.Context, method, _url string, body io.Reader, options ...Option) (*HttpResponse, error) {
+	req, cancel, err := c.NewRequest(ctx, method, _url, body, options...)
+	if err != nil {
+		return nil, err
+	}
+	defer cancel()
+	return c.read(req)
+}
+
+// read send req and read the whole response
+func (c *Client) read(req *http.Request) (*HttpResponse, error) {
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	return newHttpResponse(resp, data), nil
+}
+
+// NewRequest build a request with the options of the client and the given options, cancel must
+// be called once the response was read
+func (c *Client) NewRequest(ctx context.Context, method, _url string, body io.Reader, options ...Option) (req *http.Request, cancel context.CancelFunc, err error) {
+	if c.err != nil {
+		return nil, nil, c.err
+	}
+	r := &request{header: http.Header{}, query: url.Values{}}
+	for _, option := range c.options {
+		option(r)
+	}
+	for _, option := range options {
+		option(r)
+	}
+	if len(r.query) > 0 {
+		_url = addQuery(_url, r.query)
+	}
+	cancel = func() {}
+	if r.timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, r.timeout)
+	}
+	req, err = http.NewRequestWithContext(ctx, method, _url, body)
+	if err != nil {
+		cancel()
+		return nil, nil, err
+	}
+	for k, v := range r.header {
+		req.Header[k] = v
+	}
+	return req, cancel, nil
+}
+
+func addQuery(_url string, query url.Values) string {
+	if len(query) == 0 {
+		return _url
+	}
+	if strings.Contains(_url, "?") {
+		return _url + "&" + query.Encode()
+	}
+	return _url + "?" + query.Encode()
+}
+
+func newHttpResponse(resp *http.Response, data []byte) *HttpResponse {
+	_resp := new(HttpResponse)
+	_resp.Status = resp.StatusCode
+	_resp.Data = data
+	_resp.Headers = resp.Header
+	_resp.Header = make(map[string]string, 0)
+	for k := range resp.Header {
+		_resp.Header[k] = resp.Header.Get(k)
+	}
+	return _resp
+}
+
+// Get send a GET request
+func (c *Client) Get(ctx context.Context, _url string, options ...Option) (*HttpResponse, error) {
+	return c.Do(ctx, http.MethodGet, _url, nil, options...)
+}
+
+// Delete send a DELETE request
+func (c *Client) Delete(ctx context.Context, _url string, options ...Option) (*HttpResponse, error) {
+	return c.Do(ctx, http.MethodDelete, _url, nil, options...)
+}
+
+// Post send a POST request with a body of the given content type
+func (c *Client) Post(ctx context.Context, _url, contentType string, body io.Reader, options ...Option) (*HttpResponse, error) {
+	return c.Do(ctx, http.MethodPost, _url, body, append([]Option{WithHeader("Content-Type", contentType)}, options...)...)
+}
+
+// Put send a PUT request with a body of the given content type
+func (c *Client) Put(ctx context.Context, _url, contentType string, body io.Reader, options ...Option) (*HttpResponse, error) {
+	return c.Do(ctx, http.MethodPut, _url, body, append([]Option{WithHeader("Content-Type", contentType)}, options...)...)
+}
+
+// PostForm send a url-encoded form
+func (c *Client) PostForm(ctx context.Context, _url string, form url.Values, options ...Option) (*HttpResponse, error) {
+	return c.Post(ctx, _url, "application/x-www-form-urlencoded", strings.NewReader(form.Encode()), options...)
+}
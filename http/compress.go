@@ -0,0 +1,268 @@
+package http
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+// content codings
+const (
+	EncodingGzip    = "gzip"
+	EncodingDeflate = "deflate"
+	EncodingBrotli  = "br"
+	EncodingZstd    = "zstd"
+)
+
+// CompressionPolicy how the client compresses requests and decodes responses
+type CompressionPolicy struct {
+	// Accept encodings announced in Accept-Encoding and decoded, in order of preference, all
+	// supported encodings if empty. Requests that set Accept-Encoding themselves and Range requests
+	// get the raw body, ranges of a compressed body cannot be decoded on their own.
+	Accept []string
+	// MaxDecodedSize reading a body that decodes to more fails with ErrTooLarge, 0 means no limit
+	MaxDecodedSize int64
+	// RequestEncoding compress request bodies with this encoding, not compressed if empty
+	RequestEncoding string
+	// MinRequestSize only compress request bodies of at least this size, bodies of unknown size
+	// are always compressed
+	MinRequestSize int64
+}
+
+// DefaultCompressionPolicy decodes all supported encodings up to 256 MiB and sends bodies uncompressed
+var DefaultCompressionPolicy = CompressionPolicy{
+	MaxDecodedSize: 256 << 20,
+}
+
+// WithCompression negotiate, decode and send compressed bodies according to policy, this replaces
+// the gzip support of net/http
+func WithCompression(policy CompressionPolicy) ClientOption {
+	return func(c *Client) {
+		if len(policy.Accept) == 0 {
+			policy.Accept = []string{EncodingZstd, EncodingBrotli, EncodingGzip, EncodingDeflate}
+		}
+		for _, encoding := range append(policy.Accept, policy.RequestEncoding) {
+			if encoding != "" && !supportedEncoding(encoding) {
+				c.fail(errors.New("unsupported content encoding " + encoding))
+				return
+			}
+		}
+		c.transport.DisableCompression = true
+		c.compression = &policy
+	}
+}
+
+func supportedEncoding(encoding string) bool {
+	switch encoding {
+	case EncodingGzip, EncodingDeflate, EncodingBrotli, EncodingZstd:
+		return true
+	}
+	return false
+}
+
+// compressTransport compresses request bodies and decodes response bodies of next
+type compressTransport struct {
+	next   http.RoundTripper
+	policy CompressionPolicy
+}
+
+func (t *compressTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	decode := req.Header.Get("Accept-Encoding") == "" && req.Header.Get("Range") == ""
+	if decode || t.compresses(req) {
+		req = req.Clone(req.Context())
+	}
+	if decode {
+		req.Header.Set("Accept-Encoding", strings.Join(t.policy.Accept, ", "))
+	}
+	if t.compresses(req) {
+		t.compress(req)
+	}
+	resp, err := t.next.RoundTrip(req)
+	if err != nil || !decode || req.Method == http.MethodHead {
+		return resp, err
+	}
+	encodings := contentEncodings(resp.Header)
+	if len(encodings) == 0 {
+		return resp, nil
+	}
+	for _, encoding := range encodings {
+		if !t.accepts(encoding) {
+			// not ours to decode, hand it over as it is
+			return resp, nil
+		}
+	}
+	resp.Body = &decodedBody{
+		encodings: encodings,
+		raw:       resp.Body,
+		max:       t.policy.MaxDecodedSize,
+	}
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	resp.Uncompressed = true
+	return resp, nil
+}
+
+func (t *compressTransport) accepts(encoding string) bool {
+	for _, accepted := range t.policy.Accept {
+		if accepted == encoding {
+			return true
+		}
+	}
+	return false
+}
+
+// compresses tell if the body of req is to be compressed
+func (t *compressTransport) compresses(req *http.Request) bool {
+	return t.policy.RequestEncoding != "" && req.Body != nil && req.Body != http.NoBody &&
+		req.Header.Get("Content-Encoding") == "" &&
+		(req.ContentLength < 0 || req.ContentLength >= t.policy.MinRequestSize)
+}
+
+// compress replace the body of req by its compressed form, which is streamed
+func (t *compressTransport) compress(req *http.Request) {
+	encoding := t.policy.RequestEncoding
+	req.Body = compressBody(encoding, req.Body)
+	if getBody := req.GetBody; getBody != nil {
+		req.GetBody = func() (io.ReadCloser, error) {
+			body, err := getBody()
+			if err != nil {
+				return nil, err
+			}
+			return compressBody(encoding, body), nil
+		}
+	}
+	req.ContentLength = -1
+	req.Header.Del("Content-Length")
+	req.Header.Set("Content-Encoding", encoding)
+}
+
+func compressBody(encoding string, body io.ReadCloser) io.ReadCloser {
+	r, w := io.Pipe()
+	go func() {
+		defer body.Close()
+		encoder, err := newEncoder(encoding, w)
+		if err == nil {
+			_, err = io.Copy(encoder, body)
+			if closeErr := encoder.Close(); err == nil {
+				err = closeErr
+			}
+		}
+		w.CloseWithError(err)
+	}()
+	return r
+}
+
+func newEncoder(encoding string, w io.Writer) (io.WriteCloser, error) {
+	switch encoding {
+	case EncodingGzip:
+		return gzip.NewWriter(w), nil
+	case EncodingDeflate:
+		return zlib.NewWriter(w), nil
+	case EncodingBrotli:
+		return brotli.NewWriter(w), nil
+	case EncodingZstd:
+		return zstd.NewWriter(w)
+	}
+	return nil, errors.New("unsupported content encoding " + encoding)
+}
+
+// contentEncodings the codings of the body in the order they were applied, identity is left out
+func contentEncodings(header http.Header) []string {
+	var encodings []string
+	for _, value := range header.Values("Content-Encoding") {
+		for _, encoding := range strings.Split(value, ",") {
+			encoding = strings.ToLower(strings.TrimSpace(encoding))
+			if encoding == "x-gzip" {
+				encoding = EncodingGzip
+			}
+			if encoding != "" && encoding != "identity" {
+				encodings = append(encodings, encoding)
+			}
+		}
+	}
+	return encodings
+}
+
+// decodedBody decodes the raw body on first read, so that errors of the decoders surface from Read
+type decodedBody struct {
+	encodings []string
+	raw       io.ReadCloser
+	max       int64
+	decoded   io.Reader
+	closers   []io.Closer
+	read      int64
+	err       error
+}
+
+func (b *decodedBody) Read(p []byte) (int, error) {
+	if b.decoded == nil && b.err == nil {
+		b.err = b.init()
+	}
+	if b.err != nil {
+		return 0, b.err
+	}
+	n, err := b.decoded.Read(p)
+	b.read += int64(n)
+	if b.max > 0 && b.read > b.max {
+		b.err = ErrTooLarge
+		return 0, b.err
+	}
+	return n, err
+}
+
+// init stack the decoders, the last applied coding is decoded first
+func (b *decodedBody) init() error {
+	var r io.Reader = b.raw
+	for i := len(b.encodings) - 1; i >= 0; i-- {
+		decoder, err := newDecoder(b.encodings[i], r)
+		if err != nil {
+			return err
+		}
+		if closer, ok := decoder.(io.Closer); ok {
+			b.closers = append(b.closers, closer)
+		}
+		r = decoder
+	}
+	b.decoded = r
+	return nil
+}
+
+func (b *decodedBody) Close() error {
+	for _, closer := range b.closers {
+		closer.Close()
+	}
+	return b.raw.Close()
+}
+
+func newDecoder(encoding string, r io.Reader) (io.Reader, error) {
+	switch encoding {
+	case EncodingGzip:
+		return gzip.NewReader(r)
+	case EncodingDeflate:
+		// deflate should be zlib wrapped but some servers send raw deflate
+		buffered := bufio.NewReader(r)
+		header, err := buffered.Peek(2)
+		if err == nil && header[0]&0x0f == 8 && (uint16(header[0])<<8|uint16(header[1]))%31 == 0 {
+			return zlib.NewReader(buffered)
+		}
+		return flate.NewReader(buffered), nil
+	case EncodingBrotli:
+		return brotli.NewReader(r), nil
+	case EncodingZstd:
+		decoder, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return decoder.IOReadCloser(), nil
+	}
+	return nil, errors.New("unsupported content encoding " + encoding)
+}
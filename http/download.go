@@ -0,0 +1,271 @@
+package http
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// PartSuffix is appended to the file name of a download until it is complete
+const PartSuffix = ".part"
+
+// ValidatorSuffix is appended to the part file name for the file holding the ETag or Last-Modified
+// of the response the part file was written from, resuming sends it in If-Range
+const ValidatorSuffix = ".validator"
+
+// errors of Download
+var (
+	ErrTooLarge         = errors.New("response is larger than the maximum size")
+	ErrChecksumMismatch = errors.New("checksum of the download does not match")
+)
+
+// StatusError a response status that a streaming request did not expect
+type StatusError struct {
+	Status int
+	Header http.Header
+}
+
+func (e *StatusError) Error() string {
+	return "unexpected http status " + strconv.Itoa(e.Status)
+}
+
+// Stream send a request without reading the response, the caller must close the body.
+// The timeout of the request also covers reading the body.
+func (c *Client) Stream(ctx context.Context, method, _url string, body io.Reader, options ...Option) (*http.Response, error) {
+	req, cancel, err := c.NewRequest(ctx, method, _url, body, options...)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body = &cancelBody{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+// cancelBody releases the context of the request when the body is closed
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// DownloadOptions what Download does besides writing the response to a file
+type DownloadOptions struct {
+	// Resume continue a previous download from its part file with a Range request. The request is
+	// conditional on the validator of the earlier response, a changed file is downloaded again.
+	Resume bool
+	// MaxSize fail with ErrTooLarge when the file would become larger, 0 means no limit
+	MaxSize int64
+	// Checksum expected hex digest of the complete file, not checked if empty
+	Checksum string
+	// Hash computes the Checksum, SHA-256 if not set
+	Hash hash.Hash
+	// Progress is called after every write with the bytes written so far and the total size,
+	// total is -1 if the server did not tell
+	Progress func(written, total int64)
+}
+
+// Download get url into file. The response is written to file+PartSuffix first and renamed once it
+// is complete and verified, so file never holds a partial download. Returns the size of the file.
+func (c *Client) Download(ctx context.Context, _url, file string, download DownloadOptions, options ...Option) (int64, error) {
+	part := file + PartSuffix
+	var offset int64
+	if download.Resume {
+		info, err := os.Stat(part)
+		validator, _ := ioutil.ReadFile(part + ValidatorSuffix)
+		// without a validator the part file may belong to another version of the file
+		if err == nil && len(validator) > 0 {
+			offset = info.Size()
+			options = append(options, WithHeader("If-Range", string(validator)))
+		}
+	}
+	if offset > 0 {
+		options = append(options, WithHeader("Range", "bytes="+strconv.FormatInt(offset, 10)+"-"))
+	}
+	resp, err := c.Stream(ctx, http.MethodGet, _url, nil, options...)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	total := int64(-1)
+	switch {
+	case offset > 0 && resp.StatusCode == http.StatusPartialContent:
+		start, size, ok := contentRange(resp.Header.Get("Content-Range"))
+		if !ok || start != offset {
+			return 0, fmt.Errorf("unexpected Content-Range %q", resp.Header.Get("Content-Range"))
+		}
+		total = size
+	case offset > 0 && resp.StatusCode == http.StatusRequestedRangeNotSatisfiable:
+		// the part file may already be complete
+		if _, size, ok := contentRange(resp.Header.Get("Content-Range")); !ok || size != offset {
+			return 0, &StatusError{Status: resp.StatusCode, Header: resp.Header}
+		}
+		total = offset
+	case resp.StatusCode == http.StatusOK:
+		// no resume or the server ignored the Range header
+		offset = 0
+		if resp.ContentLength >= 0 {
+			total = resp.ContentLength
+		}
+	default:
+		return 0, &StatusError{Status: resp.StatusCode, Header: resp.Header}
+	}
+	if download.MaxSize > 0 && total > download.MaxSize {
+		return 0, ErrTooLarge
+	}
+	flag := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	if offset > 0 {
+		flag = os.O_CREATE | os.O_WRONLY | os.O_APPEND
+	} else if err = writeValidator(part, resp.Header); err != nil {
+		return 0, err
+	}
+	f, err := os.OpenFile(part, flag, 0644)
+	if err != nil {
+		return 0, err
+	}
+	written, err := download.copy(f, resp.Body, offset, total, resp.StatusCode == http.StatusRequestedRangeNotSatisfiable)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return written, err
+	}
+	if download.Checksum != "" {
+		if err = download.verify(part); err != nil {
+			os.Remove(part)
+			os.Remove(part + ValidatorSuffix)
+			return written, err
+		}
+	}
+	if err = os.Rename(part, file); err != nil {
+		return written, err
+	}
+	os.Remove(part + ValidatorSuffix)
+	return written, nil
+}
+
+// writeValidator keep the strong ETag or else the Last-Modified of a response next to the part file
+// it is written to, a response without either cannot be resumed
+func writeValidator(part string, header http.Header) error {
+	validator := header.Get("ETag")
+	if validator == "" || strings.HasPrefix(validator, "W/") {
+		validator = header.Get("Last-Modified")
+	}
+	if validator == "" {
+		err := os.Remove(part + ValidatorSuffix)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	return ioutil.WriteFile(part+ValidatorSuffix, []byte(validator), 0644)
+}
+
+// copy the body to the part file that already holds offset bytes
+func (d DownloadOptions) copy(f *os.File, body io.Reader, offset, total int64, complete bool) (int64, error) {
+	written := offset
+	if complete {
+		return written, nil
+	}
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			if d.MaxSize > 0 && written+int64(n) > d.MaxSize {
+				return written, ErrTooLarge
+			}
+			if _, werr := f.Write(buf[:n]); werr != nil {
+				return written, werr
+			}
+			written += int64(n)
+			if d.Progress != nil {
+				d.Progress(written, total)
+			}
+		}
+		if err == io.EOF {
+			if total >= 0 && written != total {
+				return written, io.ErrUnexpectedEOF
+			}
+			return written, nil
+		}
+		if err != nil {
+			return written, err
+		}
+	}
+}
+
+// verify the checksum of the whole part file, resumed downloads are hashed from the start
+func (d DownloadOptions) verify(part string) error {
+	h := d.Hash
+	if h == nil {
+		h = sha256.New()
+	}
+	h.Reset()
+	f, err := os.Open(part)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err = io.Copy(h, f); err != nil {
+		return err
+	}
+	if !strings.EqualFold(hex.EncodeToString(h.Sum(nil)), d.Checksum) {
+		return ErrChecksumMismatch
+	}
+	return nil
+}
+
+// contentRange parse "bytes start-end/size" and "bytes */size", size is -1 if unknown
+func contentRange(value string) (start, size int64, ok bool) {
+	if !strings.HasPrefix(value, "bytes ") {
+		return 0, 0, false
+	}
+	value = strings.TrimPrefix(value, "bytes ")
+	i := strings.IndexByte(value, '/')
+	if i < 0 {
+		return 0, 0, false
+	}
+	size = -1
+	if value[i+1:] != "*" {
+		var err error
+		if size, err = strconv.ParseInt(value[i+1:], 10, 64); err != nil {
+			return 0, 0, false
+		}
+	}
+	if value[:i] == "*" {
+		return 0, size, true
+	}
+	j := strings.IndexByte(value[:i], '-')
+	if j < 0 {
+		return 0, 0, false
+	}
+	start, err := strconv.ParseInt(value[:j], 10, 64)
+	return start, size, err == nil
+}
+
+// Stream Client.Stream of the DefaultClient
+func Stream(ctx context.Context, method, _url string, body io.Reader, options ...Option) (*http.Response, error) {
+	return DefaultClient.Stream(ctx, method, _url, body, options...)
+}
+
+// Download Client.Download of the DefaultClient
+func Download(ctx context.Context, _url, file string, download DownloadOptions, options ...Option) (int64, error) {
+	return DefaultClient.Download(ctx, _url, file, download, options...)
+}
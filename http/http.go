@@ -1,10 +1,8 @@
 package http
 
 import (
-	"fmt"
+	"context"
 	"io"
-	"io/ioutil"
-	"net"
 	"net/http"
 	"net/url"
 	"strings"
@@ -14,72 +12,33 @@ import (
 type HttpResponse struct {
 	Data   []byte
 	Status int
+	// Header the first value of every header
 	Header map[string]string
+	// Headers all values of every header
+	Headers http.Header
 }
 
+// Cookies parsed from the Set-Cookie headers
+func (r *HttpResponse) Cookies() []*http.Cookie {
+	return (&http.Response{Header: r.Headers}).Cookies()
+}
+
+// HTTP_TIMEOUT timeout in seconds of the package level functions
 var HTTP_TIMEOUT int = 30
 
-func getHttpClient() *http.Client {
-	client := &http.Client{
-		Transport: &http.Transport{
-			Dial: func(netw, addr string) (net.Conn, error) {
-				conn, err := net.DialTimeout(netw, addr, time.Second*time.Duration(HTTP_TIMEOUT-10))
-				if err != nil {
-					return nil, err
-				}
-				conn.SetDeadline(time.Now().Add(time.Second * time.Duration(HTTP_TIMEOUT)))
-				return conn, nil
-			},
-		},
-	}
-	return client
-}
 func HttpRequest(method, url string, header *map[string]string, _body io.Reader) (*HttpResponse, error) {
-	client := getHttpClient()
-	req, err := http.NewRequest(method, url, _body)
-	if err != nil {
-		return nil, err
-	}
-	if header != nil {
-		for k, v := range *header {
-			req.Header.Set(k, v)
-		}
-	}
-	resp, err := client.Do(req)
-	if err != nil {
-		fmt.Printf("http error:url=%s,error=%s\n", url, err.Error())
-		return nil, err //handle error
-	}
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		fmt.Printf("http body error:url=%s,error=%s\n", url, err.Error())
-		return nil, err //handle error
-	}
-	defer resp.Body.Close()
-	_resp := new(HttpResponse)
-	_resp.Status = resp.StatusCode
-	_resp.Data = body
-	_resp.Header = make(map[string]string, 0)
-	for k, _ := range resp.Header {
-		_resp.Header[k] = resp.Header.Get(k)
-	}
-	return _resp, nil
+	return HttpRequestContext(context.Background(), method, url, header, _body)
+}
+
+// HttpRequestContext HttpRequest that can be cancelled through ctx
+func HttpRequestContext(ctx context.Context, method, url string, header *map[string]string, _body io.Reader) (*HttpResponse, error) {
+	return DefaultClient.Do(ctx, method, url, _body, WithHeaders(header), WithTimeout(time.Second*time.Duration(HTTP_TIMEOUT)))
 }
 func getParamString(params *map[string]string) string {
-	q, _ := url.ParseQuery("")
-	if params != nil {
-		for name, value := range *params {
-			q.Add(name, value)
-		}
-	}
-	return q.Encode()
+	return valuesFromMap(params).Encode()
 }
 func getUrlParams(_url string, params *map[string]string) string {
-	if strings.Index(_url, "?") >= 0 {
-		return _url + "&" + getParamString(params)
-	} else {
-		return _url + "?" + getParamString(params)
-	}
+	return addQuery(_url, valuesFromMap(params))
 }
 func initHeader(header *map[string]string) map[string]string {
 	if header == nil {
@@ -87,6 +46,29 @@ func initHeader(header *map[string]string) map[string]string {
 	}
 	return *header
 }
+
+// valuesFromMap adapt a params map to url.Values, nil is allowed
+func valuesFromMap(params *map[string]string) url.Values {
+	values := url.Values{}
+	if params != nil {
+		for k, v := range *params {
+			values.Add(k, v)
+		}
+	}
+	return values
+}
+
+// headerFromMap adapt a header map to http.Header, nil is allowed
+func headerFromMap(header *map[string]string) http.Header {
+	values := http.Header{}
+	if header != nil {
+		for k, v := range *header {
+			values.Set(k, v)
+		}
+	}
+	return values
+}
+
 func GetJsonHeader() map[string]string {
 	header := make(map[string]string, 0)
 	header["Content-Type"] = "application/json"
@@ -124,3 +106,45 @@ func HttpPut(url string, params, header *map[string]string) (*HttpResponse, erro
 	}
 	return HttpRequest("POST", url, &_header, strings.NewReader(getParamString(params)))
 }
+
+// HttpRequestValues HttpRequest with a header that may repeat keys
+func HttpRequestValues(ctx context.Context, method, url string, header http.Header, body io.Reader) (*HttpResponse, error) {
+	return DefaultClient.Do(ctx, method, url, body, WithHeaderValues(header), WithTimeout(time.Second*time.Duration(HTTP_TIMEOUT)))
+}
+
+// HttpDeleteValues HttpDelete with a query and a header that may repeat keys
+func HttpDeleteValues(url string, query url.Values, header http.Header) (*HttpResponse, error) {
+	header = withContentType(header, "application/json")
+	return HttpRequestValues(context.Background(), http.MethodDelete, addQuery(url, query), header, nil)
+}
+
+// HttpGetValues HttpGet with a query and a header that may repeat keys
+func HttpGetValues(url string, query url.Values, header http.Header) (*HttpResponse, error) {
+	header = withContentType(header, "application/json")
+	return HttpRequestValues(context.Background(), http.MethodGet, addQuery(url, query), header, nil)
+}
+
+// HttpPostValues HttpPost with a form and a header that may repeat keys
+func HttpPostValues(url string, form url.Values, header http.Header) (*HttpResponse, error) {
+	header = withContentType(header, "application/x-www-form-urlencoded")
+	return HttpRequestValues(context.Background(), http.MethodPost, url, header, strings.NewReader(form.Encode()))
+}
+
+// HttpPutValues send a PUT request with a form and a header that may repeat keys, unlike HttpPut
+// which sends a POST
+func HttpPutValues(url string, form url.Values, header http.Header) (*HttpResponse, error) {
+	header = withContentType(header, "application/x-www-form-urlencoded")
+	return HttpRequestValues(context.Background(), http.MethodPut, url, header, strings.NewReader(form.Encode()))
+}
+
+// withContentType a copy of header with contentType unless it has one
+func withContentType(header http.Header, contentType string) http.Header {
+	header = header.Clone()
+	if header == nil {
+		header = http.Header{}
+	}
+	if header.Get("Content-Type") == "" {
+		header.Set("Content-Type", contentType)
+	}
+	return header
+}
@@ -3,6 +3,34 @@ package http
 import "testing"
 import "fmt"
 import "strings"
+import "context"
+import "net/http"
+import "net/http/httptest"
+import "time"
+import "sync/atomic"
+import "io/ioutil"
+import "errors"
+import "encoding/json"
+import "bytes"
+import "crypto/sha256"
+import "encoding/hex"
+import "os"
+import "path/filepath"
+import "net/url"
+import "crypto/tls"
+import "net"
+import "io"
+import "strconv"
+import "regexp"
+import "sync"
+import "compress/gzip"
+import "crypto/ecdsa"
+import "crypto/elliptic"
+import crand "crypto/rand"
+import "crypto/x509"
+import "crypto/x509/pkix"
+import "math/big"
+import "github.com/remoting/common/cert"
 
 func TestHttp_1(t *testing.T) {
 	//错误代码示范
@@ -44,3 +72,1128 @@ func TestHttp003(t *testing.T) {
 		t.Errorf("error")
 	}
 }
+
+func TestClientOptions(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, password, _ := r.BasicAuth()
+		fmt.Fprintf(w, "%s %s %s %s %s", r.Method, r.URL.RawQuery, user+":"+password, r.UserAgent(), r.Header.Get("X-Test"))
+	}))
+	defer server.Close()
+	client := NewClient(WithDefaultOptions(WithUserAgent("common"), WithHeader("X-Test", "default")))
+	resp, err := client.Get(context.Background(), server.URL+"?a=1",
+		WithQuery("b", "2"), WithBasicAuth("u", "p"), WithHeader("X-Test", "request"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(resp.Data) != "GET a=1&b=2 u:p common request" || resp.Status != http.StatusOK {
+		t.Fatal("unexpected response", string(resp.Data))
+	}
+}
+
+func TestClientCancel(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer server.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+	start := time.Now()
+	if _, err := DefaultClient.Get(ctx, server.URL); err == nil {
+		t.Fatal("cancelled request must fail")
+	}
+	if _, err := DefaultClient.Get(context.Background(), server.URL, WithTimeout(50*time.Millisecond)); err == nil {
+		t.Fatal("request must time out")
+	}
+	if time.Since(start) > 2*time.Second {
+		t.Fatal("requests were not cancelled in time")
+	}
+}
+
+func TestClientRetry(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		switch atomic.AddInt32(&calls, 1) {
+		case 1:
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case 2:
+			// drop the connection to cause a network error
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close()
+		default:
+			w.Write(body)
+		}
+	}))
+	defer server.Close()
+	policy := DefaultRetryPolicy
+	policy.InitialBackoff = time.Millisecond
+	attempts := []int{}
+	policy.OnAttempt = func(attempt Attempt) {
+		attempts = append(attempts, attempt.Number)
+	}
+	client := NewClient(WithRetry(policy))
+	resp, err := client.Put(context.Background(), server.URL, "text/plain", strings.NewReader("body"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(resp.Data) != "body" || len(attempts) != 3 {
+		t.Fatal("unexpected response", string(resp.Data), attempts)
+	}
+
+	// a streamed body is sent once
+	atomic.StoreInt32(&calls, 0)
+	resp, err = client.Put(context.Background(), server.URL, "text/plain", ioutil.NopCloser(strings.NewReader("body")))
+	if err != nil || resp.Status != http.StatusServiceUnavailable || atomic.LoadInt32(&calls) != 1 {
+		t.Fatal("streamed body must not be retried", err)
+	}
+
+	atomic.StoreInt32(&calls, 0)
+	resp, err = client.Post(context.Background(), server.URL, "text/plain", strings.NewReader("body"))
+	if err != nil || resp.Status != http.StatusServiceUnavailable {
+		t.Fatal("POST must not be retried", err)
+	}
+}
+
+func TestClientCircuitBreaker(t *testing.T) {
+	var failing int32 = 1
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&failing) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+	changes := make(chan string, 10)
+	policy := BreakerPolicy{
+		Window:           time.Minute,
+		MinRequests:      4,
+		FailureRate:      0.5,
+		Cooldown:         50 * time.Millisecond,
+		HalfOpenRequests: 1,
+		OnStateChange: func(host string, from, to CircuitState) {
+			changes <- from.String() + ">" + to.String()
+		},
+	}
+	client := NewClient(WithCircuitBreaker(policy))
+	for i := 0; i < 4; i++ {
+		if _, err := client.Get(context.Background(), server.URL); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err := client.Get(context.Background(), server.URL)
+	var openErr *CircuitOpenError
+	if !errors.As(err, &openErr) {
+		t.Fatal("expected an open circuit, got", err)
+	}
+	atomic.StoreInt32(&failing, 0)
+	time.Sleep(60 * time.Millisecond)
+	if _, err = client.Get(context.Background(), server.URL); err != nil {
+		t.Fatal("probe must pass", err)
+	}
+	if state := client.CircuitState(openErr.Host); state != CircuitClosed {
+		t.Fatal("circuit must be closed again, is", state)
+	}
+	for _, expected := range []string{"closed>open", "open>half-open", "half-open>closed"} {
+		if change := <-changes; change != expected {
+			t.Fatal("expected", expected, "got", change)
+		}
+	}
+}
+
+func TestClientJSON(t *testing.T) {
+	type item struct {
+		Name  string `json:"name"`
+		Count int    `json:"count"`
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Accept") != "application/json" {
+			t.Error("missing Accept header")
+		}
+		switch r.Method {
+		case http.MethodGet:
+			w.Write([]byte(`{"name":"a","count":1}`))
+		case http.MethodPost:
+			if r.Header.Get("Content-Type") != "application/json" {
+				t.Error("missing Content-Type header")
+			}
+			var in item
+			json.NewDecoder(r.Body).Decode(&in)
+			in.Count++
+			json.NewEncoder(w).Encode(in)
+		default:
+			w.Header().Set("X-Request-Id", "42")
+			w.WriteHeader(http.StatusConflict)
+			w.Write([]byte(`{"error":"already deleted","code":7}`))
+		}
+	}))
+	defer server.Close()
+	client := NewClient()
+	var out item
+	if err := client.GetJSON(context.Background(), server.URL, &out); err != nil || out != (item{"a", 1}) {
+		t.Fatal(out, err)
+	}
+	if err := client.PostJSON(context.Background(), server.URL, item{"b", 2}, &out); err != nil || out != (item{"b", 3}) {
+		t.Fatal(out, err)
+	}
+	err := client.DeleteJSON(context.Background(), server.URL, &out)
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) {
+		t.Fatal("expected an APIError, got", err)
+	}
+	if apiErr.Status != http.StatusConflict || apiErr.Message != "already deleted" || apiErr.Header.Get("X-Request-Id") != "42" {
+		t.Fatal(apiErr)
+	}
+	var payload struct{ Code int }
+	if err := apiErr.Decode(&payload); err != nil || payload.Code != 7 {
+		t.Fatal(payload, err)
+	}
+}
+
+func TestClientDownload(t *testing.T) {
+	content := []byte(strings.Repeat("0123456789", 1000))
+	sum := sha256.Sum256(content)
+	checksum := hex.EncodeToString(sum[:])
+	var ranges []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ranges = append(ranges, r.Header.Get("Range"))
+		w.Header().Set("ETag", `"v1"`)
+		http.ServeContent(w, r, "data", time.Time{}, bytes.NewReader(content))
+	}))
+	defer server.Close()
+	client := NewClient()
+
+	resp, err := client.Stream(context.Background(), http.MethodGet, server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	streamed, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !bytes.Equal(streamed, content) {
+		t.Fatal("streamed body differs")
+	}
+
+	dir := t.TempDir()
+	file := filepath.Join(dir, "data")
+	if err := ioutil.WriteFile(file+PartSuffix, content[:4000], 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(file+PartSuffix+ValidatorSuffix, []byte(`"v1"`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var progress []int64
+	size, err := client.Download(context.Background(), server.URL, file, DownloadOptions{
+		Resume:   true,
+		Checksum: checksum,
+		Progress: func(written, total int64) {
+			if total != int64(len(content)) {
+				t.Error("unexpected total", total)
+			}
+			progress = append(progress, written)
+		},
+	})
+	if err != nil || size != int64(len(content)) {
+		t.Fatal(size, err)
+	}
+	if ranges[len(ranges)-1] != "bytes=4000-" || progress[0] <= 4000 || progress[len(progress)-1] != size {
+		t.Fatal("download was not resumed", ranges, progress)
+	}
+	if downloaded, _ := ioutil.ReadFile(file); !bytes.Equal(downloaded, content) {
+		t.Fatal("downloaded file differs")
+	}
+	if _, err := os.Stat(file + PartSuffix); !os.IsNotExist(err) {
+		t.Fatal("part file must be gone")
+	}
+	if _, err := os.Stat(file + PartSuffix + ValidatorSuffix); !os.IsNotExist(err) {
+		t.Fatal("validator file must be gone")
+	}
+
+	// a part file of another version is replaced instead of being continued
+	ioutil.WriteFile(file+PartSuffix, []byte("old version"), 0644)
+	ioutil.WriteFile(file+PartSuffix+ValidatorSuffix, []byte(`"v0"`), 0644)
+	if size, err = client.Download(context.Background(), server.URL, file, DownloadOptions{Resume: true}); err != nil || size != int64(len(content)) {
+		t.Fatal(size, err)
+	}
+	if downloaded, _ := ioutil.ReadFile(file); !bytes.Equal(downloaded, content) {
+		t.Fatal("a changed file must be downloaded again")
+	}
+	// and a part file without validator is not trusted
+	ioutil.WriteFile(file+PartSuffix, content[:10], 0644)
+	if _, err = client.Download(context.Background(), server.URL, file, DownloadOptions{Resume: true}); err != nil || ranges[len(ranges)-1] != "" {
+		t.Fatal("a part file without validator must not be resumed", ranges, err)
+	}
+
+	if _, err = client.Download(context.Background(), server.URL, file, DownloadOptions{MaxSize: 100}); err != ErrTooLarge {
+		t.Fatal("expected ErrTooLarge, got", err)
+	}
+	if _, err = client.Download(context.Background(), server.URL, file+"2", DownloadOptions{Checksum: "00"}); err != ErrChecksumMismatch {
+		t.Fatal("expected ErrChecksumMismatch, got", err)
+	}
+	if _, err := os.Stat(file + "2"); !os.IsNotExist(err) {
+		t.Fatal("a download with a wrong checksum must not be kept")
+	}
+}
+
+func TestClientMultipart(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseMultipartForm(1 << 20); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		fmt.Fprintf(w, "%d %s", r.ContentLength, r.FormValue("name"))
+		for _, field := range []string{"config", "data", "stream"} {
+			file, header, err := r.FormFile(field)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			content, _ := ioutil.ReadAll(file)
+			fmt.Fprintf(w, " %s:%s:%s", header.Filename, header.Header.Get("Content-Type"), content)
+		}
+	}))
+	defer server.Close()
+	path := filepath.Join(t.TempDir(), "config.json")
+	ioutil.WriteFile(path, []byte(`{}`), 0644)
+	var sent, total int64
+	form := NewMultipart().
+		Field("name", "artifact").
+		File("config", path).
+		FileBytes("data", "data.bin", "", []byte("abc")).
+		FileReader("stream", "stream.txt", "text/plain", strings.NewReader("xyz"), 3).
+		OnProgress(func(s, t int64) { sent, total = s, t })
+	resp, err := NewClient().PostMultipart(context.Background(), server.URL, form)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := fmt.Sprintf("%d artifact config.json:application/json:{} data.bin:application/octet-stream:abc stream.txt:text/plain:xyz", form.ContentLength())
+	if resp.Status != http.StatusOK || string(resp.Data) != expected {
+		t.Fatal(resp.Status, string(resp.Data))
+	}
+	if sent != total || total != form.ContentLength() {
+		t.Fatal("progress", sent, total)
+	}
+	if _, err = NewClient().PostMultipart(context.Background(), server.URL, NewMultipart().File("f", path+".missing")); !os.IsNotExist(err) {
+		t.Fatal("expected a missing file, got", err)
+	}
+}
+
+func TestClientMultiValues(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Link", "<a>")
+		w.Header().Add("Link", "<b>")
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: "s1"})
+		http.SetCookie(w, &http.Cookie{Name: "theme", Value: "dark"})
+		fmt.Fprint(w, r.Method, " ", r.URL.RawQuery, " ", strings.Join(r.Header.Values("X-Tag"), ","))
+	}))
+	defer server.Close()
+	resp, err := NewClient().Get(context.Background(), server.URL,
+		WithQueryValues(url.Values{"tag": {"a", "b"}}), WithAddedHeader("X-Tag", "1"), WithAddedHeader("X-Tag", "2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(resp.Data) != "GET tag=a&tag=b 1,2" {
+		t.Fatal(string(resp.Data))
+	}
+	if links := resp.Headers.Values("Link"); len(links) != 2 || resp.Header["Link"] != "<a>" {
+		t.Fatal(links, resp.Header)
+	}
+	cookies := resp.Cookies()
+	if len(cookies) != 2 || cookies[0].Name != "session" || cookies[1].Value != "dark" {
+		t.Fatal(cookies)
+	}
+	params := map[string]string{"a": "1"}
+	header := map[string]string{}
+	resp, err = HttpPut(server.URL, &params, &header)
+	if err != nil || string(resp.Data) != "POST  " || header["Content-Type"] != "application/x-www-form-urlencoded" {
+		t.Fatal(string(resp.Data), header, err)
+	}
+	resp, err = HttpPutValues(server.URL, url.Values{"a": {"1", "2"}}, nil)
+	if err != nil || string(resp.Data) != "PUT  " {
+		t.Fatal("HttpPutValues must send PUT", string(resp.Data), err)
+	}
+}
+
+func TestClientSession(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Client") != "test" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		switch r.URL.Path {
+		case "/app/login":
+			http.SetCookie(w, &http.Cookie{Name: "session", Value: "s1", Path: "/", MaxAge: 3600})
+			fmt.Fprint(w, `<html><meta name="csrf-token" content="t&amp;1"></html>`)
+		case "/app/items":
+			if cookie, err := r.Cookie("session"); err != nil || cookie.Value != "s1" {
+				w.WriteHeader(http.StatusUnauthorized)
+			} else if r.Method == http.MethodPost && r.Header.Get("X-CSRF-Token") != "t&1" {
+				w.WriteHeader(http.StatusForbidden)
+			}
+		}
+	}))
+	defer server.Close()
+	cookieFile := filepath.Join(t.TempDir(), "cookies.json")
+	options := []SessionOption{
+		WithBaseURL(server.URL + "/app/"),
+		WithSessionHeader("X-Client", "test"),
+		WithCookieFile(cookieFile),
+		WithCSRF("X-CSRF-Token", CSRFFromHeader("X-CSRF-Token"), CSRFFromMeta("csrf-token")),
+	}
+	session, err := NewSession(options...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if resp, err := session.Get(ctx, "items"); err != nil || resp.Status != http.StatusUnauthorized {
+		t.Fatal("must not be logged in yet", err)
+	}
+	if _, err = session.Get(ctx, "login"); err != nil || session.CSRFToken() != "t&1" {
+		t.Fatal("no csrf token", session.CSRFToken(), err)
+	}
+	if resp, err := session.PostForm(ctx, "items", url.Values{"name": {"a"}}); err != nil || resp.Status != http.StatusOK {
+		t.Fatal("post failed", resp, err)
+	}
+	restored, err := NewSession(options...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp, err := restored.Get(ctx, "/app/items"); err != nil || resp.Status != http.StatusOK {
+		t.Fatal("cookies were not restored", resp, err)
+	}
+
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.Header.Get("X-Client"), r.Header.Get("X-CSRF-Token"))
+	}))
+	defer other.Close()
+	if resp, err := session.PostForm(ctx, other.URL+"/items", url.Values{"name": {"a"}}); err != nil || len(resp.Data) != 0 {
+		t.Fatal("session headers must not be sent to other hosts", string(resp.Data), err)
+	}
+}
+
+func TestClientSessionRedirect(t *testing.T) {
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.Header.Get("Authorization"), r.Header.Get("X-CSRF-Token"))
+	}))
+	defer other.Close()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/away":
+			http.Redirect(w, r, other.URL+"/x", http.StatusFound)
+		case "/here":
+			http.Redirect(w, r, "/echo", http.StatusFound)
+		case "/echo":
+			fmt.Fprint(w, r.Header.Get("Authorization"), r.Header.Get("X-CSRF-Token"))
+		}
+	}))
+	defer server.Close()
+	session, err := NewSession(WithBaseURL(server.URL), WithSessionHeader("Authorization", "Bearer secret"), WithCSRF("X-CSRF-Token"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	session.SetCSRFToken("token")
+	ctx := context.Background()
+	if resp, err := session.Post(ctx, "/here", "text/plain", strings.NewReader("")); err != nil || string(resp.Data) != "Bearer secrettoken" {
+		t.Fatal("headers must follow redirects within the origin", err)
+	}
+	if resp, err := session.Post(ctx, "/away", "text/plain", strings.NewReader("")); err != nil || len(resp.Data) != 0 {
+		t.Fatal("headers must not follow redirects to other hosts", string(resp.Data), err)
+	}
+
+	jar := NewJar()
+	jar.SetCookies(&url.URL{Scheme: "https", Host: "a.co.uk"}, []*http.Cookie{{Name: "c", Value: "1", Domain: "co.uk"}})
+	if cookies := jar.Cookies(&url.URL{Scheme: "https", Host: "b.co.uk"}); len(cookies) != 0 {
+		t.Fatal("cookies for a public suffix must be rejected", cookies)
+	}
+}
+
+func TestClientTLS(t *testing.T) {
+	dir := t.TempDir()
+	info := cert.CertInformation{CommonName: "client", CrtName: filepath.Join(dir, "client.crt"), KeyName: filepath.Join(dir, "client.key")}
+	if err := cert.CreateCRT(nil, nil, info); err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.TLS.PeerCertificates[0].Subject.CommonName)
+	}))
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert, MaxVersion: tls.VersionTLS12}
+	server.StartTLS()
+	defer server.Close()
+	ctx := context.Background()
+
+	if _, err := NewClient().Get(ctx, server.URL); err == nil {
+		t.Fatal("the test server must not be trusted by default")
+	}
+	clientCrt, clientKey, err := cert.Parse(info.CrtName, info.KeyName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, client := range []*Client{
+		NewClient(WithRootCAs(server.Certificate()), WithClientCertificate(clientCrt, clientKey)),
+		NewClient(WithRootCAs(server.Certificate()), WithClientCertificateFiles(info.CrtName, info.KeyName),
+			WithPinnedPublicKeys(PublicKeyPin(server.Certificate()))),
+	} {
+		resp, err := client.Get(ctx, server.URL)
+		if err != nil || string(resp.Data) != "client" {
+			t.Fatal(resp, err)
+		}
+	}
+	pinned := NewClient(WithRootCAs(server.Certificate()), WithClientCertificate(clientCrt, clientKey), WithPinnedPublicKeys(PublicKeyPin(clientCrt)))
+	if _, err = pinned.Get(ctx, server.URL); !errors.Is(err, ErrPinMismatch) {
+		t.Fatal("expected a pin mismatch, got", err)
+	}
+	modern := NewClient(WithRootCAs(server.Certificate()), WithClientCertificate(clientCrt, clientKey), WithMinTLSVersion(tls.VersionTLS13))
+	if _, err = modern.Get(ctx, server.URL); err == nil {
+		t.Fatal("TLS 1.2 must be refused")
+	}
+	broken := NewClient(WithCAFile(filepath.Join(dir, "missing.pem")))
+	if _, err = broken.Get(ctx, server.URL); !os.IsNotExist(err) || broken.Err() != err {
+		t.Fatal("expected the error of the option, got", err)
+	}
+}
+
+// socks5Server a minimal SOCKS5 proxy with username/password authentication
+func socks5Server(t *testing.T, user, password string) (addr string, used *int32) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	used = new(int32)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				buf := make([]byte, 512)
+				io.ReadFull(conn, buf[:2])
+				io.ReadFull(conn, buf[:buf[1]])
+				conn.Write([]byte{5, 2})
+				io.ReadFull(conn, buf[:2])
+				u := make([]byte, buf[1])
+				io.ReadFull(conn, u)
+				io.ReadFull(conn, buf[:1])
+				p := make([]byte, buf[0])
+				io.ReadFull(conn, p)
+				if string(u) != user || string(p) != password {
+					conn.Write([]byte{1, 1})
+					return
+				}
+				conn.Write([]byte{1, 0})
+				io.ReadFull(conn, buf[:4])
+				var host string
+				switch buf[3] {
+				case 1:
+					io.ReadFull(conn, buf[:4])
+					host = net.IP(buf[:4]).String()
+				case 3:
+					io.ReadFull(conn, buf[:1])
+					name := make([]byte, buf[0])
+					io.ReadFull(conn, name)
+					host = string(name)
+				}
+				io.ReadFull(conn, buf[:2])
+				target, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(int(buf[0])<<8|int(buf[1]))))
+				if err != nil {
+					conn.Write([]byte{5, 1, 0, 1, 0, 0, 0, 0, 0, 0})
+					return
+				}
+				defer target.Close()
+				atomic.AddInt32(used, 1)
+				conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+				go io.Copy(target, conn)
+				io.Copy(conn, target)
+			}()
+		}
+	}()
+	return listener.Addr().String(), used
+}
+
+func TestClientProxy(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "direct")
+	}))
+	defer target.Close()
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, password, _ := parseProxyAuthorization(r.Header.Get("Proxy-Authorization"))
+		fmt.Fprint(w, "proxied ", r.URL.IsAbs(), " ", user, ":", password)
+	}))
+	defer proxy.Close()
+	ctx := context.Background()
+	proxyURL := strings.Replace(proxy.URL, "http://", "http://me:secret@", 1)
+
+	resp, err := NewClient(WithProxy(proxyURL)).Get(ctx, target.URL)
+	if err != nil || string(resp.Data) != "proxied true me:secret" {
+		t.Fatal(resp, err)
+	}
+	resp, err = NewClient(WithProxy(proxyURL), WithNoProxy("example.com", "127.0.0.0/8")).Get(ctx, target.URL)
+	if err != nil || string(resp.Data) != "direct" {
+		t.Fatal("no proxy rule was ignored", resp, err)
+	}
+
+	socks, used := socks5Server(t, "me", "secret")
+	resp, err = NewClient(WithProxy("socks5://me:secret@"+socks)).Get(ctx, target.URL)
+	if err != nil || string(resp.Data) != "direct" || atomic.LoadInt32(used) != 1 {
+		t.Fatal("socks5 proxy was not used", resp, err)
+	}
+	if _, err = NewClient(WithoutRetry(), WithProxy("socks5://me:wrong@"+socks)).Get(ctx, target.URL); err == nil {
+		t.Fatal("socks5 authentication must fail")
+	}
+
+	routes, err := ProxyRoutes([]ProxyRoute{{Host: "internal.example", Proxy: "direct"}, {Host: "127.0.0.1", Proxy: proxyURL}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err = NewClient(WithProxyFunc(routes)).Get(ctx, target.URL)
+	if err != nil || !strings.HasPrefix(string(resp.Data), "proxied") {
+		t.Fatal("route was not used", resp, err)
+	}
+
+	for rule, expected := range map[string]bool{
+		"*": true, "example.com": true, ".example.com": true, "*.example.com": true, "other.com": false,
+		"10.0.0.0/8": false, "api.example.com:443": true, "api.example.com:80": false, "xample.com": false,
+	} {
+		u, _ := url.Parse("https://api.example.com/x")
+		if matchesNoProxy(rule, u) != expected {
+			t.Error("rule", rule, "must match", expected)
+		}
+	}
+}
+
+func parseProxyAuthorization(value string) (user, password string, ok bool) {
+	return (&http.Request{Header: http.Header{"Authorization": {value}}}).BasicAuth()
+}
+
+func TestClientRateLimit(t *testing.T) {
+	var inFlight, maxInFlight, requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&inFlight, 1)
+		defer atomic.AddInt32(&inFlight, -1)
+		for {
+			max := atomic.LoadInt32(&maxInFlight)
+			if n <= max || atomic.CompareAndSwapInt32(&maxInFlight, max, n) {
+				break
+			}
+		}
+		if r.URL.Path == "/busy" && atomic.AddInt32(&requests, 1) == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}))
+	defer server.Close()
+	ctx := context.Background()
+
+	client := NewClient(WithRateLimit(LimitPolicy{PerHost: RateLimit{Rate: 50, MaxInFlight: 2}}))
+	start := time.Now()
+	done := make(chan error)
+	for i := 0; i < 6; i++ {
+		go func() {
+			_, err := client.Get(ctx, server.URL)
+			done <- err
+		}()
+	}
+	for i := 0; i < 6; i++ {
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 90*time.Millisecond {
+		t.Fatal("rate limit was not applied", elapsed)
+	}
+	if max := atomic.LoadInt32(&maxInFlight); max > 2 {
+		t.Fatal("too many requests in flight", max)
+	}
+	host := strings.TrimPrefix(server.URL, "http://")
+	if stats := client.RateLimitStats(host); stats.Requests != 6 || stats.Delayed < 4 || stats.MaxWait <= 0 {
+		t.Fatalf("%+v", stats)
+	}
+
+	adaptive := NewClient(WithoutRetry(), WithRateLimit(LimitPolicy{Adaptive: true}))
+	if resp, err := adaptive.Get(ctx, server.URL+"/busy"); err != nil || resp.Status != http.StatusTooManyRequests {
+		t.Fatal(resp, err)
+	}
+	cancelled, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if _, err := adaptive.Get(cancelled, server.URL+"/busy"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatal("waiting must stop with the context, got", err)
+	}
+	if resp, err := adaptive.Get(ctx, server.URL+"/busy"); err != nil || resp.Status != http.StatusOK {
+		t.Fatal(resp, err)
+	}
+	if stats := adaptive.RateLimitStats(""); stats.Throttled != 1 || stats.TotalWait < 800*time.Millisecond {
+		t.Fatalf("%+v", stats)
+	}
+}
+
+func TestClientRateLimitRelease(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	ctx := context.Background()
+	client := NewClient(WithRateLimit(LimitPolicy{
+		Global:  RateLimit{MaxInFlight: 1},
+		PerHost: RateLimit{Rate: 1, Burst: 2},
+	}))
+	held, err := client.Stream(ctx, http.MethodGet, server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	timeout, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if _, err = client.Get(timeout, server.URL); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatal("waiting for the global slot must stop with the context, got", err)
+	}
+	held.Body.Close()
+	// the host token of the failed request was given back
+	start := time.Now()
+	if _, err = client.Get(ctx, server.URL); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Fatal("the host token of the cancelled request was lost", elapsed)
+	}
+}
+
+func TestClientInterceptors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer fresh" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		fmt.Fprint(w, r.Header.Get("X-Team"), " ", r.Header.Get("X-Signature"), " ", len(r.Header.Get("traceparent")), " ", string(body))
+	}))
+	defer server.Close()
+	var order []string
+	trace := func(name string) Interceptor {
+		return func(next http.RoundTripper) http.RoundTripper {
+			return RoundTripFunc(func(req *http.Request) (*http.Response, error) {
+				order = append(order, name+">")
+				resp, err := next.RoundTrip(req)
+				order = append(order, "<"+name)
+				return resp, err
+			})
+		}
+	}
+	var refreshes int
+	var metrics []RequestMetrics
+	client := NewClient(WithInterceptors(
+		trace("outer"),
+		MetricsInterceptor(func(m RequestMetrics) { metrics = append(metrics, m) }),
+		AuthInterceptor(func(ctx context.Context, refresh bool) (string, error) {
+			if refresh {
+				refreshes++
+				return "fresh", nil
+			}
+			return "stale", nil
+		}),
+		HeaderInterceptor(http.Header{"X-Team": {"core"}}),
+		SigningInterceptor(func(req *http.Request) error {
+			req.Header.Set("X-Signature", req.Method+" "+req.URL.Path)
+			return nil
+		}),
+		TracingInterceptor(nil),
+		trace("inner"),
+	))
+	resp, err := client.Post(context.Background(), server.URL+"/items", "text/plain", strings.NewReader("body"))
+	if err != nil || string(resp.Data) != "core POST /items 55 body" {
+		t.Fatal(resp, err)
+	}
+	if strings.Join(order, "") != "outer>inner><innerinner><inner<outer" || refreshes != 1 {
+		t.Fatal("unexpected order", order, refreshes)
+	}
+	if len(metrics) != 1 || metrics[0].Status != http.StatusOK || metrics[0].Path != "/items" {
+		t.Fatal(metrics)
+	}
+	if _, err = client.Get(context.Background(), server.URL); err != nil || refreshes != 1 {
+		t.Fatal("the refreshed token must be reused", err, refreshes)
+	}
+}
+
+func TestClientRecorder(t *testing.T) {
+	var hits int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&hits, 1)
+		w.Header().Set("X-Session", "secret-session")
+		body, _ := ioutil.ReadAll(r.Body)
+		fmt.Fprintf(w, `{"hit":%d,"password":"hunter2","echo":%q}`, n, body)
+	}))
+	cassette := filepath.Join(t.TempDir(), "cassette.json")
+	options := RecorderOptions{
+		Match: MatchAll(MatchMethodURL, MatchBody),
+		Redact: []Redactor{
+			RedactHeaders("Authorization", "X-Session"),
+			RedactQuery("token"),
+			RedactBody(regexp.MustCompile(`"password":"[^"]*"`), `"password":"`+Redacted+`"`),
+		},
+	}
+	options.Mode = ModeRecord
+	recorder, err := NewRecorder(cassette, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	client := NewClient(WithRecorder(recorder))
+	first, err := client.Get(ctx, server.URL+"/a?token=abc", WithBearerToken("xyz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = client.Post(ctx, server.URL+"/a?token=abc", "text/plain", strings.NewReader("b")); err != nil {
+		t.Fatal(err)
+	}
+	if err = recorder.Save(); err != nil {
+		t.Fatal(err)
+	}
+	server.Close()
+	if files, _ := ioutil.ReadDir(filepath.Dir(cassette)); len(files) != 1 {
+		t.Fatal("temporary files left next to the cassette", len(files))
+	}
+	saved, _ := ioutil.ReadFile(cassette)
+	for _, secret := range []string{"abc", "xyz", "hunter2", "secret-session"} {
+		if bytes.Contains(saved, []byte(secret)) {
+			t.Fatal("cassette contains", secret)
+		}
+	}
+
+	options.Mode = ModeReplay
+	replayer, err := NewRecorder(cassette, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client = NewClient(WithRecorder(replayer))
+	replayed, err := client.Get(ctx, server.URL+"/a?token=other")
+	if err != nil || replayed.Status != http.StatusOK || !strings.Contains(string(replayed.Data), `"hit":1`) {
+		t.Fatal(replayed, err)
+	}
+	req, _ := http.NewRequest("GET", server.URL+"/a?token=abc", nil)
+	if resp, err := replayer.transport(nil).RoundTrip(req); err != nil || resp.Status != "200 OK" {
+		t.Fatal("unexpected replayed status line", resp, err)
+	}
+	if first.Header["X-Session"] == replayed.Header["X-Session"] || replayed.Header["X-Session"] != Redacted {
+		t.Fatal("response header was not redacted", replayed.Header)
+	}
+	posted, err := client.Post(ctx, server.URL+"/a?token=abc", "text/plain", strings.NewReader("b"))
+	if err != nil || !strings.Contains(string(posted.Data), `"echo":"b"`) {
+		t.Fatal(posted, err)
+	}
+	_, err = client.Post(ctx, server.URL+"/a?token=abc", "text/plain", strings.NewReader("c"))
+	var missing *NoInteractionError
+	if !errors.As(err, &missing) {
+		t.Fatal("expected a missing interaction, got", err)
+	}
+	if atomic.LoadInt32(&hits) != 2 {
+		t.Fatal("replay must not reach the server")
+	}
+}
+
+func TestClientCache(t *testing.T) {
+	var hits sync.Map
+	count := func(path string) int32 {
+		n, _ := hits.LoadOrStore(path, new(int32))
+		return atomic.LoadInt32(n.(*int32))
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n, _ := hits.LoadOrStore(r.URL.Path, new(int32))
+		hit := atomic.AddInt32(n.(*int32), 1)
+		switch r.URL.Path {
+		case "/fresh":
+			w.Header().Set("Cache-Control", "max-age=60")
+		case "/etag":
+			w.Header().Set("Cache-Control", "no-cache")
+			w.Header().Set("ETag", `"v1"`)
+			if r.Header.Get("If-None-Match") == `"v1"` {
+				// describe the empty 304 body, not the stored one
+				w.Header().Set("Content-Encoding", "gzip")
+				w.Header().Set("Content-Range", "bytes */0")
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		case "/swr":
+			w.Header().Set("Cache-Control", "max-age=0, stale-while-revalidate=60")
+		case "/private":
+			w.Header().Set("Cache-Control", "no-store")
+		}
+		fmt.Fprint(w, r.URL.Path, " ", hit)
+	}))
+	defer server.Close()
+	ctx := context.Background()
+	memory := NewMemoryCache(10)
+	client := NewClient(WithCache(memory))
+	get := func(client *Client, path, expectedBody, expectedCache string) {
+		t.Helper()
+		resp, err := client.Get(ctx, server.URL+path)
+		if err != nil || string(resp.Data) != expectedBody || resp.Header[CacheHeader] != expectedCache {
+			t.Fatal(path, resp, err)
+		}
+	}
+	get(client, "/fresh", "/fresh 1", CacheMiss)
+	get(client, "/fresh", "/fresh 1", CacheHit)
+	get(client, "/etag", "/etag 1", CacheMiss)
+	get(client, "/etag", "/etag 1", CacheRevalidated)
+	if resp, _ := client.Get(ctx, server.URL+"/etag"); resp.Header["Content-Encoding"] != "" || resp.Header["Content-Range"] != "" {
+		t.Fatal("headers of the 304 body must not be stored", resp.Headers)
+	}
+	get(client, "/private", "/private 1", CacheMiss)
+	get(client, "/private", "/private 2", CacheMiss)
+	get(client, "/swr", "/swr 1", CacheMiss)
+	get(client, "/swr", "/swr 1", CacheStale)
+	for i := 0; count("/swr") != 2; i++ {
+		if i == 100 {
+			t.Fatal("stale response was not revalidated")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for i := 0; ; i++ {
+		resp, _ := client.Get(ctx, server.URL+"/swr")
+		if string(resp.Data) == "/swr 2" {
+			break
+		}
+		if i == 100 {
+			t.Fatal("revalidated response was not stored")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, err := client.Post(ctx, server.URL+"/fresh", "text/plain", nil); err != nil {
+		t.Fatal(err)
+	}
+	get(client, "/fresh", "/fresh 3", CacheMiss)
+	if count("/etag") != 3 {
+		t.Fatal("the etag must have been revalidated twice", count("/etag"))
+	}
+
+	small := NewClient(WithCache(NewMemoryCache(1)))
+	get(small, "/fresh", "/fresh 4", CacheMiss)
+	get(small, "/etag", "/etag 4", CacheMiss)
+	get(small, "/fresh", "/fresh 5", CacheMiss)
+
+	dir := filepath.Join(t.TempDir(), "cache")
+	disk, err := NewDiskCache(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	get(NewClient(WithCache(disk)), "/fresh", "/fresh 6", CacheMiss)
+	reopened, _ := NewDiskCache(dir)
+	get(NewClient(WithCache(reopened)), "/fresh", "/fresh 6", CacheHit)
+}
+
+func TestClientCacheAuthorization(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/public" {
+			w.Header().Set("Cache-Control", "public, max-age=60")
+		} else {
+			w.Header().Set("Cache-Control", "max-age=60")
+		}
+		fmt.Fprint(w, r.Header.Get("Authorization"))
+	}))
+	defer server.Close()
+	ctx := context.Background()
+	client := NewClient(WithCache(NewMemoryCache(10)))
+	get := func(path, user, expectedBody string) {
+		t.Helper()
+		resp, err := client.Get(ctx, server.URL+path, WithHeader("Authorization", user))
+		if err != nil || string(resp.Data) != expectedBody {
+			t.Fatal(path, user, string(resp.Data), err)
+		}
+	}
+	get("/private", "alice", "alice")
+	get("/private", "bob", "bob")
+	resp, err := client.Get(ctx, server.URL+"/private")
+	if err != nil || len(resp.Data) != 0 {
+		t.Fatal("a response for alice must not be served without credentials", string(resp.Data), err)
+	}
+	get("/private", "alice", "alice")
+	get("/public", "alice", "alice")
+	get("/public", "bob", "alice")
+}
+
+func TestClientCompression(t *testing.T) {
+	payload := strings.Repeat("compressible ", 1000)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body []byte
+		if r.Body != nil {
+			decoded := &decodedBody{encodings: contentEncodings(r.Header), raw: r.Body}
+			body, _ = ioutil.ReadAll(decoded)
+		}
+		encoding := strings.TrimPrefix(r.URL.Path, "/")
+		if encoding == "bomb" {
+			w.Header().Set("Content-Encoding", EncodingGzip)
+			gz := gzip.NewWriter(w)
+			gz.Write(make([]byte, 1<<20))
+			gz.Close()
+			return
+		}
+		if !strings.Contains(r.Header.Get("Accept-Encoding"), encoding) {
+			w.WriteHeader(http.StatusNotAcceptable)
+			return
+		}
+		w.Header().Set("Content-Encoding", encoding)
+		encoder, _ := newEncoder(encoding, w)
+		fmt.Fprint(encoder, r.Header.Get("Content-Encoding"), " ", len(body), " ", payload)
+		encoder.Close()
+	}))
+	defer server.Close()
+	ctx := context.Background()
+	client := NewClient(WithCompression(DefaultCompressionPolicy))
+	for _, encoding := range []string{EncodingGzip, EncodingDeflate, EncodingBrotli, EncodingZstd} {
+		resp, err := client.Get(ctx, server.URL+"/"+encoding)
+		if err != nil || resp.Status != http.StatusOK || string(resp.Data) != " 0 "+payload {
+			t.Fatal(encoding, err)
+		}
+		if _, ok := resp.Header["Content-Encoding"]; ok {
+			t.Fatal("Content-Encoding must be removed after decoding")
+		}
+	}
+
+	compressing := NewClient(WithCompression(CompressionPolicy{RequestEncoding: EncodingZstd, MinRequestSize: 100, MaxDecodedSize: 100000}))
+	resp, err := compressing.Post(ctx, server.URL+"/zstd", "text/plain", strings.NewReader(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := fmt.Sprintf("zstd %d ", len(payload)); !strings.HasPrefix(string(resp.Data), expected) {
+		t.Fatal("request body was not compressed", string(resp.Data)[:20])
+	}
+	resp, err = compressing.Post(ctx, server.URL+"/gzip", "text/plain", strings.NewReader("tiny"))
+	if err != nil || !strings.HasPrefix(string(resp.Data), " 4 ") {
+		t.Fatal("small bodies must not be compressed", err)
+	}
+	if _, err = compressing.Get(ctx, server.URL+"/bomb"); !errors.Is(err, ErrTooLarge) {
+		t.Fatal("expected ErrTooLarge, got", err)
+	}
+	if NewClient(WithCompression(CompressionPolicy{Accept: []string{"lzma"}})).Err() == nil {
+		t.Fatal("unsupported encodings must be rejected")
+	}
+}
+
+func TestClientCompressionRange(t *testing.T) {
+	content := []byte(strings.Repeat("0123456789", 1000))
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	gz.Write(content)
+	gz.Close()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.Header.Get("Accept-Encoding"), EncodingGzip) {
+			// ranges apply to the compressed representation
+			w.Header().Set("Content-Encoding", EncodingGzip)
+			http.ServeContent(w, r, "data", time.Time{}, bytes.NewReader(compressed.Bytes()))
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		http.ServeContent(w, r, "data", time.Time{}, bytes.NewReader(content))
+	}))
+	defer server.Close()
+	client := NewClient(WithCompression(DefaultCompressionPolicy))
+	file := filepath.Join(t.TempDir(), "data")
+	if err := ioutil.WriteFile(file+PartSuffix, content[:4000], 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(file+PartSuffix+ValidatorSuffix, []byte(`"v1"`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	size, err := client.Download(context.Background(), server.URL, file, DownloadOptions{Resume: true})
+	if err != nil || size != int64(len(content)) {
+		t.Fatal(size, err)
+	}
+	if downloaded, _ := ioutil.ReadFile(file); !bytes.Equal(downloaded, content) {
+		t.Fatal("resumed download differs")
+	}
+}
+
+// testCertificate create a certificate signed by parent, self-signed if parent is nil
+func testCertificate(t *testing.T, name string, isCA bool, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), crand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  isCA,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(crand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func TestClientPinnedChain(t *testing.T) {
+	caA, caAKey := testCertificate(t, "ca-a", true, nil, nil)
+	caB, _ := testCertificate(t, "ca-b", true, nil, nil)
+	leaf, leafKey := testCertificate(t, "leaf", false, caA, caAKey)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	// the server appends the pinned CA to a chain that does not lead to it
+	server.TLS = &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{leaf.Raw, caB.Raw}, PrivateKey: leafKey}}}
+	server.StartTLS()
+	defer server.Close()
+	ctx := context.Background()
+
+	if _, err := NewClient(WithRootCAs(caA), WithPinnedPublicKeys(PublicKeyPin(caB))).Get(ctx, server.URL); !errors.Is(err, ErrPinMismatch) {
+		t.Fatal("an unverified certificate of the chain must not match a pin, got", err)
+	}
+	if _, err := NewClient(WithRootCAs(caA), WithPinnedPublicKeys(PublicKeyPin(caA))).Get(ctx, server.URL); err != nil {
+		t.Fatal(err)
+	}
+	insecure := NewClient(WithPinnedPublicKeys(PublicKeyPin(caB)))
+	insecure.Transport().TLSClientConfig.InsecureSkipVerify = true
+	if _, err := insecure.Get(ctx, server.URL); !errors.Is(err, ErrPinMismatch) {
+		t.Fatal("without verification only the leaf may match, got", err)
+	}
+	insecure = NewClient(WithPinnedPublicKeys(PublicKeyPin(leaf)))
+	insecure.Transport().TLSClientConfig.InsecureSkipVerify = true
+	if _, err := insecure.Get(ctx, server.URL); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClientCircuitBreakerTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second):
+		}
+	}))
+	defer server.Close()
+	policy := BreakerPolicy{Window: time.Minute, MinRequests: 2, FailureRate: 0.5, Cooldown: time.Minute}
+	client := NewClient(WithCircuitBreaker(policy))
+	for i := 0; i < 2; i++ {
+		if _, err := client.Get(context.Background(), server.URL, WithTimeout(20*time.Millisecond)); !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatal("expected a timeout, got", err)
+		}
+	}
+	host := strings.TrimPrefix(server.URL, "http://")
+	if state := client.CircuitState(host); state != CircuitOpen {
+		t.Fatal("timeouts must open the circuit, it is", state)
+	}
+
+	cancelled := NewClient(WithCircuitBreaker(policy))
+	for i := 0; i < 3; i++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(10*time.Millisecond, cancel)
+		cancelled.Get(ctx, server.URL)
+		cancel()
+	}
+	if state := cancelled.CircuitState(host); state != CircuitClosed {
+		t.Fatal("requests cancelled by the caller must not open the circuit, it is", state)
+	}
+}
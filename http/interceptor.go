@@ -0,0 +1,226 @@
+package http
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/remoting/common/logger"
+)
+
+// RoundTripFunc a function that is a http.RoundTripper
+type RoundTripFunc func(req *http.Request) (*http.Response, error)
+
+// RoundTrip implements http.RoundTripper
+func (f RoundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// Interceptor wraps the RoundTripper that sends a request. Interceptors must not modify the
+// request they get, clone it instead.
+type Interceptor func(next http.RoundTripper) http.RoundTripper
+
+// WithInterceptors add interceptors around the transport of the client. The first interceptor is
+// the outermost one: it sees the request first and the response last. Interceptors run once per
+// request, retries, circuit breakers and rate limits happen inside of them.
+func WithInterceptors(interceptors ...Interceptor) ClientOption {
+	return func(c *Client) {
+		c.interceptors = append(c.interceptors, interceptors...)
+	}
+}
+
+// HeaderInterceptor set headers on every request
+func HeaderInterceptor(header http.Header) Interceptor {
+	return func(next http.RoundTripper) http.RoundTripper {
+		return RoundTripFunc(func(req *http.Request) (*http.Response, error) {
+			req = req.Clone(req.Context())
+			for k, v := range header {
+				req.Header[http.CanonicalHeaderKey(k)] = append([]string(nil), v...)
+			}
+			return next.RoundTrip(req)
+		})
+	}
+}
+
+// SigningInterceptor let sign modify a clone of every request before it is sent, like adding an
+// HMAC signature header
+func SigningInterceptor(sign func(req *http.Request) error) Interceptor {
+	return func(next http.RoundTripper) http.RoundTripper {
+		return RoundTripFunc(func(req *http.Request) (*http.Response, error) {
+			req = req.Clone(req.Context())
+			if err := sign(req); err != nil {
+				closeBody(req)
+				return nil, err
+			}
+			return next.RoundTrip(req)
+		})
+	}
+}
+
+// TokenSource supplies the bearer token of AuthInterceptor, refresh asks for a new token after the
+// current one was rejected
+type TokenSource func(ctx context.Context, refresh bool) (string, error)
+
+// AuthInterceptor authenticate with a bearer token. When a request is answered with 401 the token
+// is refreshed once and the request is sent again, if its body can be replayed.
+func AuthInterceptor(source TokenSource) Interceptor {
+	var mu sync.Mutex
+	var token string
+	current := func(ctx context.Context, refresh bool, rejected string) (string, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if token != "" && !refresh {
+			return token, nil
+		}
+		if refresh && token != rejected {
+			// another request already refreshed it
+			return token, nil
+		}
+		t, err := source(ctx, refresh)
+		if err != nil {
+			return "", err
+		}
+		token = t
+		return token, nil
+	}
+	return func(next http.RoundTripper) http.RoundTripper {
+		return RoundTripFunc(func(req *http.Request) (*http.Response, error) {
+			t, err := current(req.Context(), false, "")
+			if err != nil {
+				closeBody(req)
+				return nil, err
+			}
+			attempt := req.Clone(req.Context())
+			attempt.Header.Set("Authorization", "Bearer "+t)
+			resp, err := next.RoundTrip(attempt)
+			if err != nil || resp.StatusCode != http.StatusUnauthorized {
+				return resp, err
+			}
+			if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+				return resp, nil
+			}
+			refreshed, err := current(req.Context(), true, t)
+			if err != nil {
+				return resp, nil
+			}
+			io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64*1024))
+			resp.Body.Close()
+			attempt = req.Clone(req.Context())
+			if req.GetBody != nil {
+				if attempt.Body, err = req.GetBody(); err != nil {
+					return nil, err
+				}
+			}
+			attempt.Header.Set("Authorization", "Bearer "+refreshed)
+			return next.RoundTrip(attempt)
+		})
+	}
+}
+
+// LoggingInterceptor log every request with the logger package, failed requests as warnings
+func LoggingInterceptor() Interceptor {
+	return func(next http.RoundTripper) http.RoundTripper {
+		return RoundTripFunc(func(req *http.Request) (*http.Response, error) {
+			start := time.Now()
+			resp, err := next.RoundTrip(req)
+			elapsed := time.Since(start)
+			switch {
+			case err != nil:
+				logger.Warn("http %s %s error=%s (%s)", req.Method, req.URL.Redacted(), err.Error(), elapsed)
+			case resp.StatusCode >= 500:
+				logger.Warn("http %s %s status=%d (%s)", req.Method, req.URL.Redacted(), resp.StatusCode, elapsed)
+			default:
+				logger.Info("http %s %s status=%d (%s)", req.Method, req.URL.Redacted(), resp.StatusCode, elapsed)
+			}
+			return resp, err
+		})
+	}
+}
+
+// RequestMetrics what MetricsInterceptor observes about a request
+type RequestMetrics struct {
+	Method string
+	Host   string
+	Path   string
+	// Status 0 if there is no response
+	Status   int
+	Err      error
+	Duration time.Duration
+}
+
+// MetricsInterceptor report every request to observe once its response headers arrived
+func MetricsInterceptor(observe func(m RequestMetrics)) Interceptor {
+	return func(next http.RoundTripper) http.RoundTripper {
+		return RoundTripFunc(func(req *http.Request) (*http.Response, error) {
+			start := time.Now()
+			resp, err := next.RoundTrip(req)
+			m := RequestMetrics{Method: req.Method, Host: req.URL.Host, Path: req.URL.Path, Err: err, Duration: time.Since(start)}
+			if resp != nil {
+				m.Status = resp.StatusCode
+			}
+			observe(m)
+			return resp, err
+		})
+	}
+}
+
+// Tracer starts a span for a request, the returned request carries the span and finish ends it
+type Tracer interface {
+	Start(req *http.Request) (traced *http.Request, finish func(resp *http.Response, err error))
+}
+
+// TracingInterceptor trace every request with tracer, nil propagates W3C traceparent headers
+func TracingInterceptor(tracer Tracer) Interceptor {
+	if tracer == nil {
+		tracer = traceParentTracer{}
+	}
+	return func(next http.RoundTripper) http.RoundTripper {
+		return RoundTripFunc(func(req *http.Request) (*http.Response, error) {
+			traced, finish := tracer.Start(req)
+			resp, err := next.RoundTrip(traced)
+			finish(resp, err)
+			return resp, err
+		})
+	}
+}
+
+type traceParentKey struct{}
+
+// ContextWithTraceID let requests made with ctx join the trace, a 32 hex digit W3C trace id
+func ContextWithTraceID(ctx context.Context, traceID string) context.Context {
+	return context.WithValue(ctx, traceParentKey{}, traceID)
+}
+
+// traceParentTracer sends a traceparent header with a new span id, in the trace of the context or
+// in a new trace
+type traceParentTracer struct{}
+
+func (traceParentTracer) Start(req *http.Request) (*http.Request, func(*http.Response, error)) {
+	if req.Header.Get("traceparent") != "" {
+		return req, func(*http.Response, error) {}
+	}
+	traceID, _ := req.Context().Value(traceParentKey{}).(string)
+	if len(traceID) != 32 {
+		traceID = randomHex(16)
+	}
+	req = req.Clone(req.Context())
+	req.Header.Set("traceparent", "00-"+traceID+"-"+randomHex(8)+"-01")
+	return req, func(*http.Response, error) {}
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func closeBody(req *http.Request) {
+	if req.Body != nil {
+		req.Body.Close()
+	}
+}
@@ -0,0 +1,125 @@
+package http
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+)
+
+// APIError a response with a status of 400 or above to a JSON request
+type APIError struct {
+	Status int
+	Header http.Header
+	// Body the raw payload of the response
+	Body []byte
+	// Message taken from the message, error, detail or title field of a JSON body
+	Message string
+}
+
+func (e *APIError) Error() string {
+	message := "http status " + strconv.Itoa(e.Status)
+	if e.Message != "" {
+		message += ": " + e.Message
+	}
+	return message
+}
+
+// Decode the body into v, for APIs with a typed error payload
+func (e *APIError) Decode(v interface{}) error {
+	return json.Unmarshal(e.Body, v)
+}
+
+// newAPIError pick a message from the common fields of JSON error bodies
+func newAPIError(resp *http.Response, body []byte) *APIError {
+	apiErr := &APIError{Status: resp.StatusCode, Header: resp.Header, Body: body}
+	var fields map[string]interface{}
+	if json.Unmarshal(body, &fields) == nil {
+		for _, key := range []string{"message", "error", "detail", "title"} {
+			if message, ok := fields[key].(string); ok && message != "" {
+				apiErr.Message = message
+				break
+			}
+		}
+	}
+	return apiErr
+}
+
+// DoJSON send in as JSON body unless it is nil and decode the response into out unless it is nil.
+// Responses with a status of 400 or above are returned as *APIError.
+func (c *Client) DoJSON(ctx context.Context, method, _url string, in, out interface{}, options ...Option) error {
+	var body io.Reader
+	header := []Option{WithHeader("Accept", "application/json")}
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+		header = append(header, WithHeader("Content-Type", "application/json"))
+	}
+	req, cancel, err := c.NewRequest(ctx, method, _url, body, append(header, options...)...)
+	if err != nil {
+		return err
+	}
+	defer cancel()
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= 400 {
+		return newAPIError(resp, data)
+	}
+	if out == nil || len(bytes.TrimSpace(data)) == 0 {
+		return nil
+	}
+	return json.Unmarshal(data, out)
+}
+
+// GetJSON get url and decode the JSON response into out
+func (c *Client) GetJSON(ctx context.Context, _url string, out interface{}, options ...Option) error {
+	return c.DoJSON(ctx, http.MethodGet, _url, nil, out, options...)
+}
+
+// PostJSON post in as JSON and decode the JSON response into out
+func (c *Client) PostJSON(ctx context.Context, _url string, in, out interface{}, options ...Option) error {
+	return c.DoJSON(ctx, http.MethodPost, _url, in, out, options...)
+}
+
+// PutJSON put in as JSON and decode the JSON response into out
+func (c *Client) PutJSON(ctx context.Context, _url string, in, out interface{}, options ...Option) error {
+	return c.DoJSON(ctx, http.MethodPut, _url, in, out, options...)
+}
+
+// DeleteJSON delete url and decode the JSON response into out
+func (c *Client) DeleteJSON(ctx context.Context, _url string, out interface{}, options ...Option) error {
+	return c.DoJSON(ctx, http.MethodDelete, _url, nil, out, options...)
+}
+
+// GetJSON Client.GetJSON of the DefaultClient
+func GetJSON(ctx context.Context, _url string, out interface{}, options ...Option) error {
+	return DefaultClient.GetJSON(ctx, _url, out, options...)
+}
+
+// PostJSON Client.PostJSON of the DefaultClient
+func PostJSON(ctx context.Context, _url string, in, out interface{}, options ...Option) error {
+	return DefaultClient.PostJSON(ctx, _url, in, out, options...)
+}
+
+// PutJSON Client.PutJSON of the DefaultClient
+func PutJSON(ctx context.Context, _url string, in, out interface{}, options ...Option) error {
+	return DefaultClient.PutJSON(ctx, _url, in, out, options...)
+}
+
+// DeleteJSON Client.DeleteJSON of the DefaultClient
+func DeleteJSON(ctx context.Context, _url string, out interface{}, options ...Option) error {
+	return DefaultClient.DeleteJSON(ctx, _url, out, options...)
+}
@@ -0,0 +1,238 @@
+package http
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+)
+
+// Multipart builds a multipart/form-data body of fields and files. The body is streamed, files
+// are only opened and read while the request is sent.
+type Multipart struct {
+	boundary string
+	parts    []*formPart
+	progress func(sent, total int64)
+	err      error
+}
+
+type formPart struct {
+	name, filename, contentType string
+	// size of the content, -1 if unknown
+	size int64
+	// once the content can only be read once
+	once bool
+	open func() (io.ReadCloser, error)
+}
+
+// NewMultipart an empty multipart body
+func NewMultipart() *Multipart {
+	return &Multipart{boundary: multipart.NewWriter(nil).Boundary()}
+}
+
+// Field add a form field
+func (m *Multipart) Field(name, value string) *Multipart {
+	m.parts = append(m.parts, &formPart{
+		name: name,
+		size: int64(len(value)),
+		open: func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(strings.NewReader(value)), nil
+		},
+	})
+	return m
+}
+
+// File add the file at path, the content type is guessed from the extension
+func (m *Multipart) File(name, path string) *Multipart {
+	info, err := os.Stat(path)
+	if err != nil {
+		m.fail(err)
+		return m
+	}
+	contentType := mime.TypeByExtension(filepath.Ext(path))
+	return m.add(name, filepath.Base(path), contentType, info.Size(), func() (io.ReadCloser, error) {
+		return os.Open(path)
+	})
+}
+
+// FileBytes add a file with the given content, an empty content type means application/octet-stream
+func (m *Multipart) FileBytes(name, filename, contentType string, data []byte) *Multipart {
+	return m.add(name, filename, contentType, int64(len(data)), func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(data)), nil
+	})
+}
+
+// FileReader add a file read from r, size is -1 if unknown. A body with a reader is streamed and
+// sent once, it is not retried.
+func (m *Multipart) FileReader(name, filename, contentType string, r io.Reader, size int64) *Multipart {
+	var used int32
+	m.add(name, filename, contentType, size, func() (io.ReadCloser, error) {
+		if !atomic.CompareAndSwapInt32(&used, 0, 1) {
+			return nil, errors.New("multipart reader of " + filename + " was already read")
+		}
+		if rc, ok := r.(io.ReadCloser); ok {
+			return rc, nil
+		}
+		return ioutil.NopCloser(r), nil
+	})
+	m.parts[len(m.parts)-1].once = true
+	return m
+}
+
+// OnProgress call progress while the body is sent with the bytes sent so far and the size of the
+// body, total is -1 if a reader of unknown size was added
+func (m *Multipart) OnProgress(progress func(sent, total int64)) *Multipart {
+	m.progress = progress
+	return m
+}
+
+func (m *Multipart) add(name, filename, contentType string, size int64, open func() (io.ReadCloser, error)) *Multipart {
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	m.parts = append(m.parts, &formPart{name: name, filename: filename, contentType: contentType, size: size, open: open})
+	return m
+}
+
+func (m *Multipart) fail(err error) {
+	if m.err == nil {
+		m.err = err
+	}
+}
+
+// ContentType multipart/form-data with the boundary of the body
+func (m *Multipart) ContentType() string {
+	return "multipart/form-data; boundary=" + m.boundary
+}
+
+// ContentLength the size of the body, -1 if a reader of unknown size was added
+func (m *Multipart) ContentLength() int64 {
+	skeleton := &bytes.Buffer{}
+	w := m.writer(skeleton)
+	length := int64(0)
+	for _, part := range m.parts {
+		if part.size < 0 {
+			return -1
+		}
+		w.CreatePart(part.header())
+		length += part.size
+	}
+	w.Close()
+	return length + int64(skeleton.Len())
+}
+
+// replayable tell if Body can be called more than once
+func (m *Multipart) replayable() bool {
+	for _, part := range m.parts {
+		if part.once {
+			return false
+		}
+	}
+	return true
+}
+
+// Body the multipart body, it is written by a goroutine while it is read
+func (m *Multipart) Body() (io.ReadCloser, error) {
+	if m.err != nil {
+		return nil, m.err
+	}
+	r, w := io.Pipe()
+	go func() {
+		w.CloseWithError(m.write(m.writer(w)))
+	}()
+	if m.progress == nil {
+		return r, nil
+	}
+	return &progressReader{ReadCloser: r, total: m.ContentLength(), progress: m.progress}, nil
+}
+
+func (m *Multipart) writer(w io.Writer) *multipart.Writer {
+	mw := multipart.NewWriter(w)
+	mw.SetBoundary(m.boundary)
+	return mw
+}
+
+func (m *Multipart) write(w *multipart.Writer) error {
+	for _, part := range m.parts {
+		pw, err := w.CreatePart(part.header())
+		if err != nil {
+			return err
+		}
+		r, err := part.open()
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(pw, r)
+		r.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return w.Close()
+}
+
+var quoteEscaper = strings.NewReplacer("\\", "\\\\", `"`, "\\\"")
+
+func (p *formPart) header() textproto.MIMEHeader {
+	header := textproto.MIMEHeader{}
+	disposition := `form-data; name="` + quoteEscaper.Replace(p.name) + `"`
+	if p.filename != "" {
+		disposition += `; filename="` + quoteEscaper.Replace(p.filename) + `"`
+	}
+	header.Set("Content-Disposition", disposition)
+	if p.contentType != "" {
+		header.Set("Content-Type", p.contentType)
+	}
+	return header
+}
+
+// progressReader reports the bytes read from the body
+type progressReader struct {
+	io.ReadCloser
+	sent, total int64
+	progress    func(sent, total int64)
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if n > 0 {
+		r.sent += int64(n)
+		r.progress(r.sent, r.total)
+	}
+	return n, err
+}
+
+// PostMultipart send a multipart form
+func (c *Client) PostMultipart(ctx context.Context, _url string, form *Multipart, options ...Option) (*HttpResponse, error) {
+	body, err := form.Body()
+	if err != nil {
+		return nil, err
+	}
+	options = append([]Option{WithHeader("Content-Type", form.ContentType())}, options...)
+	req, cancel, err := c.NewRequest(ctx, http.MethodPost, _url, nil, options...)
+	if err != nil {
+		body.Close()
+		return nil, err
+	}
+	defer cancel()
+	req.Body = body
+	req.ContentLength = form.ContentLength()
+	if form.replayable() {
+		req.GetBody = form.Body
+	}
+	return c.read(req)
+}
+
+// PostMultipart Client.PostMultipart of the DefaultClient
+func PostMultipart(ctx context.Context, _url string, form *Multipart, options ...Option) (*HttpResponse, error) {
+	return DefaultClient.PostMultipart(ctx, _url, form, options...)
+}
@@ -0,0 +1,277 @@
+package http
+
+import (
+	"context"
+	"io"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// RateLimit a token bucket and a cap on concurrent requests, zero values are unlimited
+type RateLimit struct {
+	// Rate requests per second
+	Rate float64
+	// Burst requests that may be sent at once after a quiet period, 1 if not set
+	Burst int
+	// MaxInFlight requests sent but not yet answered and read
+	MaxInFlight int
+}
+
+// LimitPolicy the rate limits of a client
+type LimitPolicy struct {
+	// Global limits all requests of the client together
+	Global RateLimit
+	// PerHost limits the requests to each host
+	PerHost RateLimit
+	// Hosts replace PerHost for single hosts, keyed by host or host:port as in the url
+	Hosts map[string]RateLimit
+	// Adaptive pause a host that answered 429 Too Many Requests for its Retry-After, 1 second if it
+	// did not send one, and halve its rate. The rate recovers with every successful response.
+	Adaptive bool
+}
+
+// RateLimitStats how the limits delayed requests
+type RateLimitStats struct {
+	// Requests that passed the limits
+	Requests int64
+	// Delayed requests that had to wait
+	Delayed int64
+	// Throttled 429 responses
+	Throttled          int64
+	TotalWait, MaxWait time.Duration
+}
+
+// WithRateLimit limit the rate and concurrency of the requests of the client
+func WithRateLimit(policy LimitPolicy) ClientOption {
+	return func(c *Client) {
+		c.limiter = &limiter{
+			policy: policy,
+			global: newHostLimiter(policy.Global),
+			hosts:  map[string]*hostLimiter{},
+		}
+	}
+}
+
+// RateLimitStats the stats of the requests to host, "" for all requests of the client
+func (c *Client) RateLimitStats(host string) RateLimitStats {
+	if c.limiter == nil {
+		return RateLimitStats{}
+	}
+	h := c.limiter.global
+	if host != "" {
+		h = c.limiter.host(host)
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.stats
+}
+
+type limiter struct {
+	policy LimitPolicy
+	global *hostLimiter
+	mu     sync.Mutex
+	hosts  map[string]*hostLimiter
+}
+
+func (l *limiter) host(host string) *hostLimiter {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	h, ok := l.hosts[host]
+	if !ok {
+		limit, ok := l.policy.Hosts[host]
+		if !ok {
+			limit = l.policy.PerHost
+		}
+		h = newHostLimiter(limit)
+		l.hosts[host] = h
+	}
+	return h
+}
+
+// hostLimiter a token bucket and a semaphore
+type hostLimiter struct {
+	limit       RateLimit
+	slots       chan struct{}
+	mu          sync.Mutex
+	rate        float64
+	tokens      float64
+	last        time.Time
+	pausedUntil time.Time
+	stats       RateLimitStats
+}
+
+func newHostLimiter(limit RateLimit) *hostLimiter {
+	h := &hostLimiter{limit: limit, rate: limit.Rate, tokens: float64(limit.burst())}
+	if limit.MaxInFlight > 0 {
+		h.slots = make(chan struct{}, limit.MaxInFlight)
+	}
+	return h
+}
+
+func (l RateLimit) burst() int {
+	if l.Burst < 1 {
+		return 1
+	}
+	return l.Burst
+}
+
+// reserve take a token, the returned wait is how long the caller has to wait before it may send
+func (h *hostLimiter) reserve(now time.Time) time.Duration {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var wait time.Duration
+	if h.rate > 0 {
+		if !h.last.IsZero() {
+			h.tokens = math.Min(float64(h.limit.burst()), h.tokens+now.Sub(h.last).Seconds()*h.rate)
+		}
+		h.last = now
+		h.tokens--
+		if h.tokens < 0 {
+			wait = time.Duration(-h.tokens / h.rate * float64(time.Second))
+		}
+	}
+	if pause := h.pausedUntil.Sub(now); pause > wait {
+		wait = pause
+	}
+	return wait
+}
+
+// unreserve give back the token of a request that was cancelled before it was sent
+func (h *hostLimiter) unreserve() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.rate > 0 {
+		h.tokens++
+	}
+}
+
+// take wait for a token and a slot, the returned func frees the slot
+func (h *hostLimiter) take(ctx context.Context) (release func(), err error) {
+	if wait := h.reserve(time.Now()); wait > 0 {
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			h.unreserve()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+	if h.slots == nil {
+		return func() {}, nil
+	}
+	select {
+	case h.slots <- struct{}{}:
+		return func() { <-h.slots }, nil
+	case <-ctx.Done():
+		h.unreserve()
+		return nil, ctx.Err()
+	}
+}
+
+func (h *hostLimiter) record(wait time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.stats.Requests++
+	if wait > time.Millisecond {
+		h.stats.Delayed++
+		h.stats.TotalWait += wait
+		if wait > h.stats.MaxWait {
+			h.stats.MaxWait = wait
+		}
+	}
+}
+
+// throttle pause after a 429 response and halve the rate, never below a tenth of the limit
+func (h *hostLimiter) throttle(now time.Time, pause time.Duration, adapt bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.stats.Throttled++
+	if !adapt {
+		return
+	}
+	if until := now.Add(pause); until.After(h.pausedUntil) {
+		h.pausedUntil = until
+	}
+	if h.rate > 0 {
+		h.rate = math.Max(h.rate/2, h.limit.Rate/10)
+	}
+}
+
+// recover raise the rate by a tenth of the limit after a successful response
+func (h *hostLimiter) recover() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.rate > 0 && h.rate < h.limit.Rate {
+		h.rate = math.Min(h.rate+h.limit.Rate/10, h.limit.Rate)
+	}
+}
+
+// limitTransport delays the requests of next according to the limits
+type limitTransport struct {
+	next    http.RoundTripper
+	limiter *limiter
+}
+
+func (t *limitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	host := t.limiter.host(req.URL.Host)
+	var releases []func()
+	release := func() {
+		for _, r := range releases {
+			r()
+		}
+	}
+	var taken []*hostLimiter
+	for _, h := range []*hostLimiter{host, t.limiter.global} {
+		r, err := h.take(req.Context())
+		if err != nil {
+			// the request is not sent, give back what the limits before already handed out
+			release()
+			for _, previous := range taken {
+				previous.unreserve()
+			}
+			if req.Body != nil {
+				req.Body.Close()
+			}
+			return nil, err
+		}
+		releases = append(releases, r)
+		taken = append(taken, h)
+	}
+	wait := time.Since(start)
+	host.record(wait)
+	t.limiter.global.record(wait)
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusTooManyRequests {
+		pause, ok := retryAfter(resp)
+		if !ok {
+			pause = time.Second
+		}
+		host.throttle(time.Now(), pause, t.limiter.policy.Adaptive)
+		t.limiter.global.throttle(time.Now(), 0, false)
+	} else if resp.StatusCode < 400 {
+		host.recover()
+	}
+	// the request is in flight until its body is closed
+	resp.Body = &releaseBody{ReadCloser: resp.Body, release: release}
+	return resp, nil
+}
+
+type releaseBody struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (b *releaseBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return err
+}
@@ -0,0 +1,208 @@
+package http
+
+import (
+	"crypto/tls"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// RetryPolicy when and how often failed requests are repeated. Requests with a body are only
+// repeated if the body can be read again through Request.GetBody, which is the case for bodies of
+// bytes, strings and forms. Streamed bodies like file uploads are sent once without retries.
+type RetryPolicy struct {
+	// MaxAttempts number of attempts including the first one, values below 2 disable retries
+	MaxAttempts int
+	// InitialBackoff wait before the first retry, doubled by Multiplier for every further retry
+	InitialBackoff time.Duration
+	// MaxBackoff upper limit of the wait between attempts
+	MaxBackoff time.Duration
+	// Multiplier growth factor of the backoff, 2 if not set
+	Multiplier float64
+	// Jitter randomizes each backoff by up to this fraction, 0.2 means +-20%
+	Jitter float64
+	// RetryStatus response status codes that are retried
+	RetryStatus []int
+	// RetryNonIdempotent also retry POST and PATCH requests without an Idempotency-Key header
+	RetryNonIdempotent bool
+	// MaxRetryAfter responses asking to wait longer with Retry-After are not retried
+	MaxRetryAfter time.Duration
+	// OnAttempt is called after every attempt
+	OnAttempt func(attempt Attempt)
+}
+
+// Attempt the result of one try of a request
+type Attempt struct {
+	Request *http.Request
+	// Number starts at 1
+	Number   int
+	Response *http.Response
+	Err      error
+	// Wait until the next attempt, 0 if there will be none
+	Wait time.Duration
+}
+
+// DefaultRetryPolicy retries idempotent requests twice on network errors and overload responses
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:    3,
+	InitialBackoff: 100 * time.Millisecond,
+	MaxBackoff:     5 * time.Second,
+	Multiplier:     2,
+	Jitter:         0.2,
+	RetryStatus:    []int{http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout},
+	MaxRetryAfter:  30 * time.Second,
+}
+
+// WithRetry retry failed requests of the client according to policy
+func WithRetry(policy RetryPolicy) ClientOption {
+	return func(c *Client) {
+		c.retry = &policy
+	}
+}
+
+// WithoutRetry disable the retries of the client
+func WithoutRetry() ClientOption {
+	return func(c *Client) {
+		c.retry = nil
+	}
+}
+
+// retryTransport repeats requests of next according to policy
+type retryTransport struct {
+	next   http.RoundTripper
+	policy RetryPolicy
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.policy.MaxAttempts < 2 || !t.policy.retries(req) || !replayable(req) {
+		return t.next.RoundTrip(req)
+	}
+	var err error
+	for number := 1; ; number++ {
+		attempt := req
+		if number > 1 && req.GetBody != nil {
+			attempt = req.Clone(req.Context())
+			attempt.Body, err = req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+		}
+		resp, err := t.next.RoundTrip(attempt)
+		wait, retry := t.policy.next(req, number, resp, err)
+		if t.policy.OnAttempt != nil {
+			t.policy.OnAttempt(Attempt{Request: attempt, Number: number, Response: resp, Err: err, Wait: wait})
+		}
+		if !retry {
+			return resp, err
+		}
+		if resp != nil {
+			// drain so that the connection can be reused
+			io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64*1024))
+			resp.Body.Close()
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// retries tell if the method of req may be repeated
+func (p RetryPolicy) retries(req *http.Request) bool {
+	if p.RetryNonIdempotent || req.Header.Get("Idempotency-Key") != "" {
+		return true
+	}
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete, "":
+		return true
+	}
+	return false
+}
+
+// next decide whether there is another attempt after attempt number and how long to wait for it
+func (p RetryPolicy) next(req *http.Request, number int, resp *http.Response, err error) (wait time.Duration, retry bool) {
+	if number >= p.MaxAttempts || req.Context().Err() != nil {
+		return 0, false
+	}
+	if err != nil {
+		return p.backoff(number), !isPermanent(err)
+	}
+	if !p.retryStatus(resp.StatusCode) {
+		return 0, false
+	}
+	wait = p.backoff(number)
+	if after, ok := retryAfter(resp); ok {
+		if p.MaxRetryAfter > 0 && after > p.MaxRetryAfter {
+			return 0, false
+		}
+		if after > wait {
+			wait = after
+		}
+	}
+	return wait, true
+}
+
+func (p RetryPolicy) retryStatus(status int) bool {
+	for _, s := range p.RetryStatus {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+// backoff before the attempt following attempt number
+func (p RetryPolicy) backoff(number int) time.Duration {
+	multiplier := p.Multiplier
+	if multiplier <= 0 {
+		multiplier = 2
+	}
+	backoff := float64(p.InitialBackoff) * math.Pow(multiplier, float64(number-1))
+	if p.MaxBackoff > 0 && backoff > float64(p.MaxBackoff) {
+		backoff = float64(p.MaxBackoff)
+	}
+	if p.Jitter > 0 {
+		backoff += backoff * p.Jitter * (2*rand.Float64() - 1)
+	}
+	return time.Duration(backoff)
+}
+
+// retryAfter parse the Retry-After header, seconds or an HTTP date
+func retryAfter(resp *http.Response) (time.Duration, bool) {
+	value := resp.Header.Get("Retry-After")
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		wait := time.Until(date)
+		if wait < 0 {
+			wait = 0
+		}
+		return wait, true
+	}
+	return 0, false
+}
+
+// isPermanent errors that another attempt cannot fix
+func isPermanent(err error) bool {
+	var certErr *tls.CertificateVerificationError
+	var openErr *CircuitOpenError
+	var missingErr *NoInteractionError
+	return errors.As(err, &certErr) || errors.As(err, &openErr) || errors.As(err, &missingErr) || errors.Is(err, ErrPinMismatch)
+}
+
+// replayable tell if the body of req can be sent again, streamed bodies are not buffered
+func replayable(req *http.Request) bool {
+	return req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+}
@@ -0,0 +1,423 @@
+package http
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"html"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+// Jar an in memory cookie jar that can be saved to and loaded from a file
+type Jar struct {
+	jar     *cookiejar.Jar
+	mu      sync.Mutex
+	cookies map[string]jarEntry
+	changed bool
+}
+
+// jarEntry a cookie and the url that set it, as saved to the file
+type jarEntry struct {
+	URL    string       `json:"url"`
+	Cookie *http.Cookie `json:"cookie"`
+}
+
+var _ http.CookieJar = &Jar{}
+
+// NewJar an empty cookie jar
+func NewJar() *Jar {
+	// without the public suffix list a server could set cookies for all of co.uk
+	jar, _ := cookiejar.New(&cookiejar.Options{PublicSuffixList: publicsuffix.List})
+	return &Jar{jar: jar, cookies: map[string]jarEntry{}}
+}
+
+// LoadJar a cookie jar with the cookies saved to file, a missing file gives an empty jar
+func LoadJar(file string) (*Jar, error) {
+	j := NewJar()
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return j, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var entries []jarEntry
+	if err = json.Unmarshal(data, &entries); err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		u, err := url.Parse(entry.URL)
+		if err != nil || entry.Cookie == nil {
+			continue
+		}
+		j.SetCookies(u, []*http.Cookie{entry.Cookie})
+	}
+	j.changed = false
+	return j, nil
+}
+
+// SetCookies implements http.CookieJar
+func (j *Jar) SetCookies(u *url.URL, cookies []*http.Cookie) {
+	j.jar.SetCookies(u, cookies)
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	now := time.Now()
+	for _, cookie := range cookies {
+		key := jarKey(u, cookie)
+		if cookie.MaxAge < 0 || (!cookie.Expires.IsZero() && cookie.Expires.Before(now)) {
+			delete(j.cookies, key)
+			j.changed = true
+			continue
+		}
+		saved := *cookie
+		if saved.MaxAge > 0 {
+			// saved cookies must not live longer when they are loaded again
+			saved.Expires = now.Add(time.Duration(saved.MaxAge) * time.Second)
+			saved.MaxAge = 0
+		}
+		j.cookies[key] = jarEntry{URL: (&url.URL{Scheme: u.Scheme, Host: u.Host, Path: u.Path}).String(), Cookie: &saved}
+		j.changed = true
+	}
+}
+
+// Cookies implements http.CookieJar
+func (j *Jar) Cookies(u *url.URL) []*http.Cookie {
+	return j.jar.Cookies(u)
+}
+
+// Save write the cookies to file, only readable by the owner
+func (j *Jar) Save(file string) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	now := time.Now()
+	entries := make([]jarEntry, 0, len(j.cookies))
+	for key, entry := range j.cookies {
+		if !entry.Cookie.Expires.IsZero() && entry.Cookie.Expires.Before(now) {
+			delete(j.cookies, key)
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(file), filepath.Base(file)+".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), file)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	j.changed = false
+	return nil
+}
+
+// saveIfChanged save to file unless nothing changed since the last save
+func (j *Jar) saveIfChanged(file string) error {
+	j.mu.Lock()
+	changed := j.changed
+	j.mu.Unlock()
+	if !changed {
+		return nil
+	}
+	return j.Save(file)
+}
+
+func jarKey(u *url.URL, cookie *http.Cookie) string {
+	domain := strings.ToLower(strings.TrimPrefix(cookie.Domain, "."))
+	if domain == "" {
+		domain = strings.ToLower(u.Hostname())
+	}
+	return domain + ";" + cookie.Path + ";" + cookie.Name
+}
+
+// WithCookieJar keep cookies between the requests of the client
+func WithCookieJar(jar http.CookieJar) ClientOption {
+	return func(c *Client) {
+		c.client.Jar = jar
+	}
+}
+
+// CSRFExtractor finds a CSRF token in a response, empty if there is none
+type CSRFExtractor func(resp *HttpResponse) string
+
+// CSRFFromCookie take the token from a cookie the response sets, like XSRF-TOKEN
+func CSRFFromCookie(name string) CSRFExtractor {
+	return func(resp *HttpResponse) string {
+		for _, cookie := range resp.Cookies() {
+			if cookie.Name == name {
+				return cookie.Value
+			}
+		}
+		return ""
+	}
+}
+
+// CSRFFromHeader take the token from a response header
+func CSRFFromHeader(name string) CSRFExtractor {
+	return func(resp *HttpResponse) string {
+		return resp.Headers.Get(name)
+	}
+}
+
+// CSRFFromMeta take the token from a HTML meta tag like <meta name="csrf-token" content="...">
+func CSRFFromMeta(name string) CSRFExtractor {
+	quoted := regexp.QuoteMeta(name)
+	patterns := []*regexp.Regexp{
+		regexp.MustCompile(`<meta[^>]+name=["']` + quoted + `["'][^>]+content=["']([^"']*)["']`),
+		regexp.MustCompile(`<meta[^>]+content=["']([^"']*)["'][^>]+name=["']` + quoted + `["']`),
+	}
+	return func(resp *HttpResponse) string {
+		for _, pattern := range patterns {
+			if match := pattern.FindSubmatch(resp.Data); match != nil {
+				return html.UnescapeString(string(match[1]))
+			}
+		}
+		return ""
+	}
+}
+
+// Session a client that keeps cookies, default headers and a CSRF token between requests and
+// resolves request urls against a base url
+type Session struct {
+	client        *Client
+	clientOptions []ClientOption
+	jar           *Jar
+	cookieFile    string
+	baseURL       *url.URL
+	header        http.Header
+	csrfHeader    string
+	csrfExtract   []CSRFExtractor
+	mu            sync.Mutex
+	csrfToken     string
+}
+
+// SessionOption configures a Session in NewSession
+type SessionOption func(s *Session) error
+
+// WithBaseURL resolve relative request urls against base
+func WithBaseURL(base string) SessionOption {
+	return func(s *Session) error {
+		u, err := url.Parse(base)
+		if err != nil {
+			return err
+		}
+		s.baseURL = u
+		return nil
+	}
+}
+
+// WithSessionHeader send a header with every request of the session to the base url's origin
+func WithSessionHeader(key, value string) SessionOption {
+	return func(s *Session) error {
+		s.header.Set(key, value)
+		return nil
+	}
+}
+
+// WithCookieFile load the cookies from file and save them there whenever they change
+func WithCookieFile(file string) SessionOption {
+	return func(s *Session) error {
+		jar, err := LoadJar(file)
+		if err != nil {
+			return err
+		}
+		s.jar = jar
+		s.cookieFile = file
+		return nil
+	}
+}
+
+// WithCSRF send the last token found by extractors in header with every unsafe request to the
+// base url's origin
+func WithCSRF(header string, extractors ...CSRFExtractor) SessionOption {
+	return func(s *Session) error {
+		s.csrfHeader = header
+		s.csrfExtract = extractors
+		return nil
+	}
+}
+
+// WithClientOptions configure the client of the session
+func WithClientOptions(options ...ClientOption) SessionOption {
+	return func(s *Session) error {
+		s.clientOptions = append(s.clientOptions, options...)
+		return nil
+	}
+}
+
+// NewSession create a session with an in memory cookie jar unless WithCookieFile is given
+func NewSession(options ...SessionOption) (*Session, error) {
+	s := &Session{header: http.Header{}}
+	for _, option := range options {
+		if err := option(s); err != nil {
+			return nil, err
+		}
+	}
+	if s.jar == nil {
+		s.jar = NewJar()
+	}
+	s.client = NewClient(append(s.clientOptions, WithCookieJar(s.jar))...)
+	if err := s.client.Err(); err != nil {
+		return nil, err
+	}
+	s.client.client.CheckRedirect = s.checkRedirect
+	return s, nil
+}
+
+// checkRedirect strip the session headers and the CSRF token from redirects that leave the origin
+// of the base url, or of the first request without a base url
+func (s *Session) checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= 10 {
+		return errors.New("stopped after 10 redirects")
+	}
+	origin := s.baseURL
+	if origin == nil {
+		origin = via[0].URL
+	}
+	if !sameOrigin(req.URL, origin) {
+		for key := range s.header {
+			req.Header.Del(key)
+		}
+		if s.csrfHeader != "" {
+			req.Header.Del(s.csrfHeader)
+		}
+	}
+	return nil
+}
+
+// Client the client of the session
+func (s *Session) Client() *Client {
+	return s.client
+}
+
+// Jar the cookies of the session
+func (s *Session) Jar() *Jar {
+	return s.jar
+}
+
+// CSRFToken the token sent with unsafe requests
+func (s *Session) CSRFToken() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.csrfToken
+}
+
+// SetCSRFToken set the token sent with unsafe requests
+func (s *Session) SetCSRFToken(token string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.csrfToken = token
+}
+
+// URL resolve ref against the base url
+func (s *Session) URL(ref string) (string, error) {
+	if s.baseURL == nil {
+		return ref, nil
+	}
+	u, err := url.Parse(ref)
+	if err != nil {
+		return "", err
+	}
+	return s.baseURL.ResolveReference(u).String(), nil
+}
+
+// Do send a request with the headers, cookies and CSRF token of the session, the headers and the
+// token are left out for urls outside the scheme and host of the base url
+func (s *Session) Do(ctx context.Context, method, ref string, body io.Reader, options ...Option) (*HttpResponse, error) {
+	_url, err := s.URL(ref)
+	if err != nil {
+		return nil, err
+	}
+	var defaults []Option
+	if s.sameOrigin(_url) {
+		defaults = append(defaults, WithHeaderValues(s.header))
+		if token := s.CSRFToken(); token != "" && s.csrfHeader != "" && !safeMethod(method) {
+			defaults = append(defaults, WithHeader(s.csrfHeader, token))
+		}
+	}
+	resp, err := s.client.Do(ctx, method, _url, body, append(defaults, options...)...)
+	if err != nil {
+		return nil, err
+	}
+	for _, extract := range s.csrfExtract {
+		if token := extract(resp); token != "" {
+			s.SetCSRFToken(token)
+			break
+		}
+	}
+	if s.cookieFile != "" {
+		if err = s.jar.saveIfChanged(s.cookieFile); err != nil {
+			return resp, err
+		}
+	}
+	return resp, nil
+}
+
+// sameOrigin tell if the session headers and CSRF token may be sent to rawURL, that is to the
+// scheme and host of the base url, or anywhere without a base url
+func (s *Session) sameOrigin(rawURL string) bool {
+	if s.baseURL == nil {
+		return true
+	}
+	u, err := url.Parse(rawURL)
+	return err == nil && sameOrigin(u, s.baseURL)
+}
+
+func sameOrigin(u, origin *url.URL) bool {
+	return strings.EqualFold(u.Scheme, origin.Scheme) && strings.EqualFold(u.Host, origin.Host)
+}
+
+func safeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+	return false
+}
+
+// Get send a GET request
+func (s *Session) Get(ctx context.Context, ref string, options ...Option) (*HttpResponse, error) {
+	return s.Do(ctx, http.MethodGet, ref, nil, options...)
+}
+
+// Delete send a DELETE request
+func (s *Session) Delete(ctx context.Context, ref string, options ...Option) (*HttpResponse, error) {
+	return s.Do(ctx, http.MethodDelete, ref, nil, options...)
+}
+
+// Post send a POST request with a body of the given content type
+func (s *Session) Post(ctx context.Context, ref, contentType string, body io.Reader, options ...Option) (*HttpResponse, error) {
+	return s.Do(ctx, http.MethodPost, ref, body, append([]Option{WithHeader("Content-Type", contentType)}, options...)...)
+}
+
+// Put send a PUT request with a body of the given content type
+func (s *Session) Put(ctx context.Context, ref, contentType string, body io.Reader, options ...Option) (*HttpResponse, error) {
+	return s.Do(ctx, http.MethodPut, ref, body, append([]Option{WithHeader("Content-Type", contentType)}, options...)...)
+}
+
+// PostForm send a url-encoded form
+func (s *Session) PostForm(ctx context.Context, ref string, form url.Values, options ...Option) (*HttpResponse, error) {
+	return s.Post(ctx, ref, "application/x-www-form-urlencoded", strings.NewReader(form.Encode()), options...)
+}
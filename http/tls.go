@@ -0,0 +1,136 @@
+package http
+
+import (
+	"crypto"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+	"strings"
+)
+
+// ErrPinMismatch the server presented no certificate with a pinned public key
+var ErrPinMismatch = errors.New("no certificate of the server matches a pinned public key")
+
+// tlsConfig the TLS configuration of the transport, created on first use
+func (c *Client) tlsConfig() *tls.Config {
+	if c.transport.TLSClientConfig == nil {
+		c.transport.TLSClientConfig = &tls.Config{}
+	}
+	return c.transport.TLSClientConfig
+}
+
+// rootCAs the pool of trusted CAs, empty on first use so that only the given CAs are trusted
+func (c *Client) rootCAs() *x509.CertPool {
+	config := c.tlsConfig()
+	if config.RootCAs == nil {
+		config.RootCAs = x509.NewCertPool()
+	}
+	return config.RootCAs
+}
+
+// WithRootCAs trust certificates issued by the given CAs instead of the system CAs, certificates
+// from cert.ParseCrt can be used directly
+func WithRootCAs(certs ...*x509.Certificate) ClientOption {
+	return func(c *Client) {
+		pool := c.rootCAs()
+		for _, cert := range certs {
+			pool.AddCert(cert)
+		}
+	}
+}
+
+// WithCAPEM trust the CAs of a PEM bundle instead of the system CAs
+func WithCAPEM(bundle []byte) ClientOption {
+	return func(c *Client) {
+		if !c.rootCAs().AppendCertsFromPEM(bundle) {
+			c.fail(errors.New("no certificates in the CA bundle"))
+		}
+	}
+}
+
+// WithCAFile trust the CAs of a PEM bundle file instead of the system CAs
+func WithCAFile(file string) ClientOption {
+	return func(c *Client) {
+		bundle, err := ioutil.ReadFile(file)
+		if err != nil {
+			c.fail(err)
+			return
+		}
+		WithCAPEM(bundle)(c)
+	}
+}
+
+// WithClientCertificate present a client certificate, the types of cert.Parse can be used directly
+func WithClientCertificate(cert *x509.Certificate, key crypto.PrivateKey) ClientOption {
+	return func(c *Client) {
+		config := c.tlsConfig()
+		config.Certificates = append(config.Certificates, tls.Certificate{
+			Certificate: [][]byte{cert.Raw},
+			PrivateKey:  key,
+			Leaf:        cert,
+		})
+	}
+}
+
+// WithClientCertificateFiles present the client certificate of a PEM certificate and key file
+func WithClientCertificateFiles(certFile, keyFile string) ClientOption {
+	return func(c *Client) {
+		certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			c.fail(err)
+			return
+		}
+		config := c.tlsConfig()
+		config.Certificates = append(config.Certificates, certificate)
+	}
+}
+
+// WithMinTLSVersion refuse servers that do not support version, like tls.VersionTLS12
+func WithMinTLSVersion(version uint16) ClientOption {
+	return func(c *Client) {
+		c.tlsConfig().MinVersion = version
+	}
+}
+
+// WithPinnedPublicKeys only accept servers with a certificate in their verified chain whose public
+// key has one of the pins, see PublicKeyPin. This is checked in addition to the normal verification,
+// without verification only the leaf certificate is matched.
+func WithPinnedPublicKeys(pins ...string) ClientOption {
+	return func(c *Client) {
+		pinned := make(map[string]bool, len(pins))
+		for _, pin := range pins {
+			pinned[strings.TrimPrefix(pin, "sha256/")] = true
+		}
+		config := c.tlsConfig()
+		config.VerifyConnection = func(state tls.ConnectionState) error {
+			// only verified certificates count, a server can send any certificate along its chain
+			var certs []*x509.Certificate
+			for _, chain := range state.VerifiedChains {
+				certs = append(certs, chain...)
+			}
+			if config.InsecureSkipVerify && len(state.PeerCertificates) > 0 {
+				certs = state.PeerCertificates[:1]
+			}
+			for _, cert := range certs {
+				if pinned[publicKeyPin(cert)] {
+					return nil
+				}
+			}
+			return ErrPinMismatch
+		}
+	}
+}
+
+// PublicKeyPin the pin of the public key of cert, sha256/ and the base64 SHA-256 of its
+// SubjectPublicKeyInfo as in HPKP
+func PublicKeyPin(cert *x509.Certificate) string {
+	return "sha256/" + publicKeyPin(cert)
+}
+
+func publicKeyPin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}